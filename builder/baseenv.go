@@ -0,0 +1,106 @@
+package builder
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/andrew-d/sbuild/config"
+	"github.com/andrew-d/sbuild/env"
+)
+
+// Directories of host tools that are on the PATH in a hermetic build, after
+// the toolchain's directories.  /usr/local is deliberately left out.
+var hermeticPath = []string{"/usr/bin", "/bin", "/usr/sbin", "/sbin"}
+
+// Returns the directory that is used as HOME in hermetic builds.  It's emptied
+// at the start of every build.
+func homeDir(config *config.BuildConfig) string {
+	return filepath.Join(config.BuildDir, "home")
+}
+
+// Returns the environment that every recipe's environment is based on.  This
+// is the environment of this process, unless the build is hermetic, in which
+// case it only contains an allowlisted set of variables, plus the
+// configuration's extra variables.
+func baseEnv(config *config.BuildConfig) *env.Env {
+	var ret *env.Env
+	if config.Hermetic {
+		path := append(toolchainDirs(config.Platform, config.Arch), hermeticPath...)
+		ret = env.Empty().
+			Set("PATH", strings.Join(path, string(filepath.ListSeparator))).
+			Set("HOME", homeDir(config)).
+			Set("LC_ALL", "C").
+			Set("TZ", "UTC")
+	} else {
+		ret = env.FromOS()
+	}
+
+	for k, v := range config.ExtraEnv {
+		ret = ret.Set(k, v)
+	}
+	return ret
+}
+
+// Returns the host directories that contain the compilers for the given
+// platform and architecture, found using this process's PATH.
+func toolchainDirs(platform, arch string) []string {
+	prefix := CrossPrefix(platform, arch)
+
+	var ret []string
+	seen := make(map[string]bool)
+	for _, tool := range []string{prefix + "-gcc", prefix + "-clang"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			continue
+		}
+
+		dir, err := filepath.Abs(filepath.Dir(path))
+		if err != nil || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		ret = append(ret, dir)
+	}
+	return ret
+}
+
+// Adds the host environment variables that a recipe asks for to the given
+// environment, if they're set.  Does nothing unless the build is hermetic,
+// since the environment already contains every host variable otherwise.
+func addHostEnv(config *config.BuildConfig, e *env.Env, names []string) *env.Env {
+	if !config.Hermetic {
+		return e
+	}
+
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			e = e.Set(name, value)
+		}
+	}
+	return e
+}
+
+// Returns the variables in the given environment as a map.
+func envMap(e *env.Env) map[string]string {
+	ret := make(map[string]string)
+	for _, v := range e.AsSlice() {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 {
+			ret[parts[0]] = parts[1]
+		}
+	}
+	return ret
+}
+
+// Returns the names of the variables in the given map, sorted.
+func sortedKeys(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
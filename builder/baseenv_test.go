@@ -0,0 +1,47 @@
+package builder
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+func TestHermeticBaseEnv(t *testing.T) {
+	os.Setenv("SBUILD_TEST_HOST_VAR", "from-host")
+	defer os.Unsetenv("SBUILD_TEST_HOST_VAR")
+
+	conf := &config.BuildConfig{
+		BuildDir: "/build",
+		Platform: "linux",
+		Arch:     "amd64",
+		Hermetic: true,
+	}
+
+	base := baseEnv(conf)
+	vars := envMap(base)
+	assert.Equal(t, []string{"HOME", "LC_ALL", "PATH", "TZ"}, sortedKeys(vars))
+	assert.Equal(t, "/build/home", vars["HOME"])
+	assert.Equal(t, "C", vars["LC_ALL"])
+	assert.Equal(t, "UTC", vars["TZ"])
+	assert.Contains(t, vars["PATH"], "/usr/bin")
+
+	// Only variables that are asked for are passed through.
+	e := addHostEnv(conf, base, []string{"SBUILD_TEST_HOST_VAR", "SBUILD_TEST_UNSET_VAR"})
+	assert.Equal(t, "from-host", e.Get("SBUILD_TEST_HOST_VAR"))
+	_, ok := e.GetOk("SBUILD_TEST_UNSET_VAR")
+	assert.False(t, ok)
+
+	// Extra variables are added, and override the allowlisted ones.
+	conf.ExtraEnv = map[string]string{"TZ": "Pacific/Kiritimati", "FOO": "bar"}
+	vars = envMap(baseEnv(conf))
+	assert.Equal(t, "Pacific/Kiritimati", vars["TZ"])
+	assert.Equal(t, "bar", vars["FOO"])
+	conf.ExtraEnv = nil
+
+	// Without hermetic builds, everything is inherited.
+	conf.Hermetic = false
+	assert.Equal(t, "from-host", baseEnv(conf).Get("SBUILD_TEST_HOST_VAR"))
+}
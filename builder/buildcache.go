@@ -0,0 +1,324 @@
+package builder
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/andrew-d/sbuild/env"
+	"github.com/andrew-d/sbuild/types"
+	"github.com/andrew-d/sbuild/util"
+	"github.com/andrew-d/sbuild/util/assets"
+)
+
+// Increased whenever the builder changes how recipes are built, so that
+// builds from older versions are not reused.
+const keyVersion = 1
+
+// buildInputs contains everything that can affect the result of building a
+// single recipe.  Two builds with the same inputs are assumed to produce the
+// same outputs.
+type buildInputs struct {
+	Recipe types.Recipe
+
+	// Map of direct dependency name --> key of that dependency's build.
+	DepKeys map[string]string
+
+	Platform    string
+	Arch        string
+	CrossPrefix string
+	StaticFlags string
+
+	// Whether the build is reproducible.
+	Reproducible bool
+
+	// The base environment of a hermetic build, or nil.
+	BaseEnv map[string]string
+
+	// Identifies the compiler used for the build.
+	Toolchain string
+
+	// Files that sbuild itself provides to recipes (e.g. config.sub), by
+	// name, as returned by sharedAssets.
+	SharedAssets map[string][]byte
+}
+
+// Returns every file that sbuild provides to recipes, in addition to their
+// own assets.  Recipes don't declare which of these they use, so every build
+// depends on all of them.
+func sharedAssets() map[string][]byte {
+	ret := make(map[string][]byte)
+	for _, name := range assets.AssetNames() {
+		ret[name] = assets.MustAsset(name)
+	}
+	return ret
+}
+
+// Key returns a hash of all inputs to this build.
+func (b *buildInputs) Key() string {
+	h := sha256.New()
+	info := b.Recipe.Info()
+
+	fmt.Fprintf(h, "builder %d\n", keyVersion)
+	fmt.Fprintf(h, "name %q\n", info.Name)
+	fmt.Fprintf(h, "version %q\n", info.Version)
+	fmt.Fprintf(h, "revision %d\n", info.Revision)
+	for i, source := range info.Sources {
+		fmt.Fprintf(h, "source %q %q\n", source, info.Sums[i])
+	}
+
+	fmt.Fprintf(h, "exports %q %q %q\n",
+		info.Exports.IncludeDirs, info.Exports.LibDirs, info.Exports.Libs)
+
+	if ar, ok := b.Recipe.(types.AssetRecipe); ok {
+		assets := ar.Assets()
+		names := make([]string, 0, len(assets))
+		for name := range assets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(h, "asset %q %x\n", name, sha256.Sum256(assets[name]))
+		}
+	}
+
+	shared := make([]string, 0, len(b.SharedAssets))
+	for name := range b.SharedAssets {
+		shared = append(shared, name)
+	}
+	sort.Strings(shared)
+	for _, name := range shared {
+		fmt.Fprintf(h, "shared asset %q %x\n", name, sha256.Sum256(b.SharedAssets[name]))
+	}
+
+	deps := make([]string, 0, len(b.DepKeys))
+	for dep := range b.DepKeys {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+	for _, dep := range deps {
+		fmt.Fprintf(h, "dep %q %s\n", dep, b.DepKeys[dep])
+	}
+
+	fmt.Fprintf(h, "platform %q\n", b.Platform)
+	fmt.Fprintf(h, "arch %q\n", b.Arch)
+	fmt.Fprintf(h, "prefix %q\n", b.CrossPrefix)
+	fmt.Fprintf(h, "static %q\n", b.StaticFlags)
+	fmt.Fprintf(h, "reproducible %t\n", b.Reproducible)
+	fmt.Fprintf(h, "source date %d\n", info.SourceDateEpoch)
+	fmt.Fprintf(h, "toolchain %q\n", b.Toolchain)
+	for _, k := range sortedKeys(b.BaseEnv) {
+		fmt.Fprintf(h, "env %q %q\n", k, b.BaseEnv[k])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns a string that identifies the compiler named by the given
+// environment's CC variable - its resolved path, a hash of the binary, and its
+// reported version.  Running the compiler stops if the context is cancelled.
+func toolchainID(runCtx stdcontext.Context, e *env.Env) (string, error) {
+	fields := strings.Fields(e.Get("CC"))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("builder: no compiler set in environment")
+	}
+
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(path, "--version")
+	cmd.Env = e.AsSlice()
+	cmd.Stdout = &stdout
+	if err := util.RunCommand(runCtx, cmd); err != nil {
+		return "", err
+	}
+
+	version := strings.SplitN(stdout.String(), "\n", 2)[0]
+	return fmt.Sprintf("%s %x %s", path, h.Sum(nil), version), nil
+}
+
+// buildRecord describes a single finished build.
+type buildRecord struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Key     string `json:"key"`
+
+	// Environment variables that this build exported to its dependents.
+	Env map[string]string `json:"env"`
+}
+
+// buildCache stores the results of finished builds, keyed by the hash of the
+// build's inputs.  Each entry is a directory containing a 'record.json' file,
+// an 'outputs' directory with a copy of the recipe's output directory, and a
+// 'staging' directory with a copy of everything the recipe installed for its
+// dependents.
+type buildCache struct {
+	rootDir string
+}
+
+func newBuildCache(rootDir string) (*buildCache, error) {
+	if err := os.MkdirAll(rootDir, 0700); err != nil {
+		return nil, err
+	}
+
+	ret := &buildCache{
+		rootDir: rootDir,
+	}
+	return ret, nil
+}
+
+// Lookup returns the record of a previous build with the given key, or nil if
+// no such build exists or it can no longer be used.
+func (c *buildCache) Lookup(key string) (*buildRecord, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.rootDir, key, "record.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rec := &buildRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// Restore copies the outputs of the given build into the output directory, and
+// the files it installed into the staging directory, replacing anything that
+// was already in either of them.
+func (c *buildCache) Restore(rec *buildRecord, outDir, stagingDir string) error {
+	if err := os.RemoveAll(outDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	if err := copyTree(filepath.Join(c.rootDir, rec.Key, "outputs"), outDir); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return err
+	}
+	staging := filepath.Join(c.rootDir, rec.Key, "staging")
+	if _, err := os.Stat(staging); os.IsNotExist(err) {
+		return nil
+	}
+	return copyTree(staging, stagingDir)
+}
+
+// Store saves the given build, along with copies of its output and staging
+// directories, in the cache.
+func (c *buildCache) Store(rec *buildRecord, outDir, stagingDir string) error {
+	entryDir := filepath.Join(c.rootDir, rec.Key)
+
+	// Write the new entry to a temporary directory first, so that an
+	// interrupted store never leaves a partial entry behind.
+	tmpDir, err := ioutil.TempDir(c.rootDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := copyTree(outDir, filepath.Join(tmpDir, "outputs")); err != nil {
+		return err
+	}
+	if err := copyTree(stagingDir, filepath.Join(tmpDir, "staging")); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "record.json"), data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(entryDir); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, entryDir)
+}
+
+// Recursively copies the contents of one directory into another, preserving
+// file modes.
+func copyTree(source, target string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(target, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dest, info.Mode().Perm()|0700)
+
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.Remove(dest)
+			return os.Symlink(link, dest)
+		}
+
+		return copyFile(path, dest, info.Mode().Perm())
+	})
+}
+
+func copyFile(source, target string, mode os.FileMode) error {
+	sourcef, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourcef.Close()
+
+	targetf, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer targetf.Close()
+
+	if _, err := io.Copy(targetf, sourcef); err != nil {
+		return err
+	}
+
+	return nil
+}
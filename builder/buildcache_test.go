@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/types"
+	"github.com/andrew-d/sbuild/util/assets"
+)
+
+type testRecipe struct {
+	info   types.RecipeInfo
+	deps   []string
+	assets map[string][]byte
+}
+
+func (r *testRecipe) Info() *types.RecipeInfo                          { return &r.info }
+func (r *testRecipe) Dependencies(platform, arch string) []string      { return r.deps }
+func (r *testRecipe) Prepare(ctx *types.BuildContext) error            { return nil }
+func (r *testRecipe) Build(ctx *types.BuildContext) error              { return nil }
+func (r *testRecipe) Finalize(ctx *types.BuildContext, o string) error { return nil }
+func (r *testRecipe) Assets() map[string][]byte                        { return r.assets }
+
+func testInputs() *buildInputs {
+	return &buildInputs{
+		Recipe: &testRecipe{
+			info: types.RecipeInfo{
+				Name:    "foo",
+				Version: "1.0",
+				Sources: []string{"http://example.com/foo-${version}.tar.gz"},
+				Sums:    []string{"abcd"},
+			},
+			assets: map[string][]byte{"fix.patch": []byte("patch")},
+		},
+		DepKeys:      map[string]string{"bar": "1234"},
+		Platform:     "linux",
+		Arch:         "amd64",
+		CrossPrefix:  "x86_64-linux-musl",
+		StaticFlags:  " -static ",
+		Toolchain:    "gcc 1.0",
+		SharedAssets: map[string][]byte{"config.sub": []byte("#!/bin/sh")},
+	}
+}
+
+func TestBuildKeyStable(t *testing.T) {
+	assert.Equal(t, testInputs().Key(), testInputs().Key())
+}
+
+func TestBuildKeyChanges(t *testing.T) {
+	base := testInputs().Key()
+
+	for desc, modify := range map[string]func(*buildInputs){
+		"version":   func(b *buildInputs) { b.Recipe.(*testRecipe).info.Version = "1.1" },
+		"revision":  func(b *buildInputs) { b.Recipe.(*testRecipe).info.Revision = 1 },
+		"sum":       func(b *buildInputs) { b.Recipe.(*testRecipe).info.Sums[0] = "ef01" },
+		"asset":     func(b *buildInputs) { b.Recipe.(*testRecipe).assets["fix.patch"] = []byte("new") },
+		"dep key":   func(b *buildInputs) { b.DepKeys["bar"] = "5678" },
+		"arch":      func(b *buildInputs) { b.Arch = "arm" },
+		"static":    func(b *buildInputs) { b.StaticFlags = "" },
+		"toolchain": func(b *buildInputs) { b.Toolchain = "gcc 2.0" },
+		"base env":  func(b *buildInputs) { b.BaseEnv = map[string]string{"TZ": "UTC"} },
+		"shared asset": func(b *buildInputs) {
+			b.SharedAssets["config.sub"] = []byte("#!/bin/bash")
+		},
+	} {
+		inputs := testInputs()
+		modify(inputs)
+		assert.NotEqual(t, base, inputs.Key(), "changing %s should change the key", desc)
+	}
+}
+
+func TestSharedAssets(t *testing.T) {
+	// Recipes copy config.sub into their sources, so it must be part of
+	// every build key.
+	shared := sharedAssets()
+	assert.Equal(t, assets.MustAsset("config.sub"), shared["config.sub"])
+}
+
+func TestBuildCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := newBuildCache(filepath.Join(dir, "builds"))
+	require.NoError(t, err)
+
+	outDir := filepath.Join(dir, "out")
+	stagingDir := filepath.Join(dir, "staging")
+	require.NoError(t, os.MkdirAll(outDir, 0700))
+	require.NoError(t, os.MkdirAll(filepath.Join(stagingDir, "usr", "lib"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outDir, "foo"), []byte("binary"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(stagingDir, "usr", "lib", "libfoo.a"), []byte("library"), 0644))
+
+	rec, err := cache.Lookup("key")
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+	require.NoError(t, cache.Store(&buildRecord{
+		Name: "foo",
+		Key:  "key",
+		Env:  map[string]string{"LDFLAGS": "-lfoo"},
+	}, outDir, stagingDir))
+
+	rec, err = cache.Lookup("key")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, "-lfoo", rec.Env["LDFLAGS"])
+
+	// Restoring replaces anything already in the output and staging
+	// directories.
+	newOut := filepath.Join(dir, "out2")
+	newStaging := filepath.Join(dir, "staging2")
+	for _, d := range []string{newOut, newStaging} {
+		require.NoError(t, os.MkdirAll(d, 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(d, "stale"), nil, 0644))
+	}
+	require.NoError(t, cache.Restore(rec, newOut, newStaging))
+
+	data, err := ioutil.ReadFile(filepath.Join(newOut, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "binary", string(data))
+
+	data, err = ioutil.ReadFile(filepath.Join(newStaging, "usr", "lib", "libfoo.a"))
+	require.NoError(t, err)
+	assert.Equal(t, "library", string(data))
+
+	for _, d := range []string{newOut, newStaging} {
+		_, err = os.Stat(filepath.Join(d, "stale"))
+		assert.True(t, os.IsNotExist(err), d)
+	}
+}
@@ -1,29 +1,54 @@
 package builder
 
 import (
+	stdcontext "context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
 	"github.com/andrew-d/sbuild/config"
 	"github.com/andrew-d/sbuild/env"
 	"github.com/andrew-d/sbuild/logmgr"
+	"github.com/andrew-d/sbuild/sandbox"
 	"github.com/andrew-d/sbuild/types"
 	"github.com/andrew-d/sbuild/util"
 )
 
-const DETERMINISTIC = false
+// The prefix that libraries are installed with, relative to a sysroot.
+const installPrefix = "/usr"
 
 // Keeps information about a single build.
 type context struct {
+	// Cancelled when the build is interrupted.
+	runCtx stdcontext.Context
+
 	rootEnv *env.Env
 	config  *config.BuildConfig
 	cache   *sourceCache
+	builds  *buildCache
+	journal *journal
+	report  *reportBuilder
+
+	// Recipes that were explicitly selected for rebuilding, and so should not
+	// be taken from the build cache.
+	force map[string]bool
 
-	// Map of package --> environment variable map
+	// Map of package --> environment variable map, map of package --> key of
+	// the finished build, and map of compiler --> toolchain identity.  Since
+	// multiple recipes can be built at once, these must only be accessed
+	// with envLock held.
 	packageEnv map[string]map[string]string
+	buildKeys  map[string]string
+	toolchains map[string]string
+	envLock    sync.Mutex
 }
 
 var (
@@ -31,85 +56,207 @@ var (
 )
 
 // Build will run a build for the recipe with the given name and using the
-// provided configuration.
-func Build(recipes []string, config *config.BuildConfig) error {
+// provided configuration.  If runCtx is cancelled, the build stops and any
+// commands that are running are killed.
+func Build(runCtx stdcontext.Context, recipes []string, config *config.BuildConfig) error {
 	log.WithField("recipes", recipes).Info("Starting build")
-	cacheDir := filepath.Join(config.BuildDir, ".cache")
+	if config.Sandbox && !sandbox.Supported {
+		return fmt.Errorf("builder: sandboxed builds are not supported on %s", runtime.GOOS)
+	}
+	if config.EmptyRoot && !sandbox.Supported {
+		return fmt.Errorf("builder: running tests in an empty root is not supported on %s", runtime.GOOS)
+	}
+	if err := checkHardening(config.Hardening); err != nil {
+		return err
+	}
+
+	cacheDir := config.SourceCacheDir()
+	buildsDir := filepath.Join(config.BuildDir, ".builds")
 
 	// Ensure build, output, and cache directories exist.
 	for _, dir := range []string{config.BuildDir, config.OutputDir, cacheDir} {
 		log.WithField("dir", dir).Debug("Ensuring directory exists")
-		if err := os.Mkdir(dir, 0700); err != nil {
-			if !os.IsExist(err) {
-				log.WithFields(logrus.Fields{
-					"dir": dir,
-					"err": err,
-				}).Error("Could not create directory")
-				return err
-			}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.WithFields(logrus.Fields{
+				"dir": dir,
+				"err": err,
+			}).Error("Could not create directory")
+			return err
+		}
+	}
+
+	// Hermetic builds get an empty home directory, so nothing in the user's
+	// home directory can affect them.
+	if config.Hermetic {
+		home := homeDir(config)
+		err := os.RemoveAll(home)
+		if err == nil {
+			err = os.MkdirAll(home, 0700)
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"dir": home,
+				"err": err,
+			}).Error("Could not create home directory")
+			return err
 		}
 	}
 
-	// Get dependency order for all input recipes.
-	deps, err := getRecipeDeps(recipes, config.Platform, config.Arch)
+	// Get the dependency graph for all input recipes, and ensure that it
+	// doesn't contain any cycles.
+	depgraph, err := recipeGraph(recipes, config.Platform, config.Arch)
+	if err == nil {
+		_, err = sortGraph(depgraph)
+	}
 	if err != nil {
 		log.WithField("err", err).Error("Could not get recipe dependencies")
 		return err
 	}
 
-	cache, err := newSourceCache(cacheDir)
+	cache, err := newSourceCache(cacheDir, config.Rewrites)
 	if err != nil {
 		log.WithField("err", err).Error("Could not create source cache")
 		return err
 	}
 
+	builds, err := newBuildCache(buildsDir)
+	if err != nil {
+		log.WithField("err", err).Error("Could not create build cache")
+		return err
+	}
+
+	journal, err := openJournal(filepath.Join(config.BuildDir, "journal.json"))
+	if err != nil {
+		log.WithField("err", err).Error("Could not open build journal")
+		return err
+	}
+
+	// Figure out which recipes we're rebuilding.  Any others will reuse the
+	// results recorded in the journal.
+	rebuild, err := selectRecipes(depgraph, config.From, config.Only)
+	if err != nil {
+		log.WithField("err", err).Error("Could not select recipes to build")
+		return err
+	}
+
+	// Offline builds can't download anything, so make sure that they won't
+	// have to before starting.
+	if config.Offline {
+		cache.offline = true
+		if err := checkSourcesCached(recipes, config, rebuild); err != nil {
+			log.WithField("err", err).Error("Sources are missing from the cache")
+			return err
+		}
+	}
+
 	// Make our context
 	ctx := context{
-		rootEnv:    env.FromOS(),
+		runCtx:     runCtx,
+		rootEnv:    baseEnv(config),
 		config:     config,
 		cache:      cache,
+		builds:     builds,
+		journal:    journal,
+		report:     newReportBuilder(config.Platform, config.Arch),
+		force:      rebuild,
 		packageEnv: make(map[string]map[string]string),
+		buildKeys:  make(map[string]string),
+		toolchains: make(map[string]string),
+	}
+	// Every recipe is in the report, even if it's never built.  Only what
+	// doesn't depend on the recipe's dependencies can be known up front.
+	for name := range depgraph {
+		info := recipesRegistry[name].Info()
+		sources, _ := expandSources(info)
+		ctx.report.Add(info, sources, ctx.recipeBaseEnv(info), ctx.outDir(name, info))
 	}
 
-	// For each dependency, we build it.
-	for _, dep := range deps {
-		if err = buildOne(dep, &ctx); err != nil {
+	// Build each dependency once everything it depends on has been built.
+	sched := newScheduler(depgraph, config.Jobs)
+	err = sched.run(func(dep string) error {
+		if rebuild != nil && !rebuild[dep] {
+			if err := ctx.reuseRecorded(dep); err != nil {
+				ctx.report.Fail(dep, err)
+				return err
+			}
+			ctx.status(dep, "reused previous build")
+			return nil
+		}
+
+		if err := buildOne(dep, &ctx); err != nil {
 			log.WithFields(logrus.Fields{
 				"dep": dep,
 				"err": err,
 			}).Error("Error building dependency")
+			ctx.report.Fail(dep, err)
+			ctx.status(dep, "FAILED")
 			return err
 		}
+		return nil
+	})
+
+	// Write a report of the build, whether or not it succeeded.  Failing to
+	// do so doesn't affect the result of the build.
+	reportPath := filepath.Join(config.BuildDir, reportFile)
+	if rerr := ctx.report.Done(err).Write(reportPath); rerr != nil {
+		log.WithFields(logrus.Fields{
+			"path": reportPath,
+			"err":  rerr,
+		}).Warn("Could not write build report")
+	} else {
+		log.WithField("path", reportPath).Info("Wrote build report")
 	}
 
-	return nil
+	return err
 }
 
-func buildOne(name string, ctx *context) error {
-	log.WithField("recipe", name).Info("Building single recipe")
-	recipe := recipesRegistry[name]
+// buildSetup contains everything needed to run the build of a single recipe.
+type buildSetup struct {
+	Recipe    types.Recipe
+	Info      *types.RecipeInfo
+	SourceDir string
+	OutDir    string
 
-	// Remove and re-create the source directory for this build.
-	sourceDir := filepath.Join(ctx.config.BuildDir, name)
-	if err := os.RemoveAll(sourceDir); err != nil {
-		log.WithFields(logrus.Fields{
-			"recipe": name,
-			"err":    err,
-		}).Error("Could not remove source directory")
-		return err
-	}
-	if err := os.Mkdir(sourceDir, 0700); err != nil {
-		log.WithFields(logrus.Fields{
-			"recipe": name,
-			"err":    err,
-		}).Error("Could not create source directory")
-		return err
-	}
+	// Where this recipe installs files for its dependents, and where the
+	// files installed by its dependencies are gathered.
+	StagingDir string
+	SysrootDir string
 
-	info := recipe.Info()
-	for i, source := range info.Sources {
-		// Expand the source.
-		expandedSource := os.Expand(source, func(vname string) string {
+	// Sources for this recipe, and the mirrors for each of them, with all
+	// variables expanded.
+	Sources []string
+	Mirrors [][]string
+
+	// The environment and flags that the recipe is built with.
+	Env            *env.Env
+	DependencyEnv  map[string]map[string]string
+	CrossPrefix    string
+	StaticFlags    string
+	ConfigureFlags []string
+	Libs           string
+
+	// The variables that the recipe's environment is based on, if the build
+	// is hermetic.  Otherwise, nil, since the environment is inherited from
+	// sbuild.
+	BaseEnv map[string]string
+
+	// Names of all dependencies of this recipe, direct and indirect, in link
+	// order.
+	deps []string
+
+	// The environment without any per-recipe compiler flags, which is used
+	// to identify the compiler.
+	compilerEnv *env.Env
+
+	// Map of direct dependency name --> key of that dependency's build.
+	depKeys map[string]string
+}
+
+// Returns the sources of the given recipe, and the mirrors for each of them,
+// with all variables expanded.
+func expandSources(info *types.RecipeInfo) (sources []string, mirrors [][]string) {
+	expand := func(source string) string {
+		return os.Expand(source, func(vname string) string {
 			if vname == "name" {
 				return info.Name
 			} else if vname == "version" {
@@ -118,51 +265,101 @@ func buildOne(name string, ctx *context) error {
 
 			panic(fmt.Sprintf("unknown expansion variable: %s", vname))
 		})
+	}
 
-		// Fetch the source
-		if err := ctx.cache.Fetch(
-			name,
-			expandedSource,
-			info.Sums[i],
-			sourceDir,
-		); err != nil {
-			log.WithFields(logrus.Fields{
-				"recipe": name,
-				"source": expandedSource,
-				"hash":   info.Sums[i],
-				"err":    err,
-			}).Error("Could not fetch source")
-			return err
+	for i, source := range info.Sources {
+		sources = append(sources, expand(source))
+
+		var expanded []string
+		if i < len(info.Mirrors) {
+			for _, mirror := range info.Mirrors[i] {
+				expanded = append(expanded, expand(mirror))
+			}
 		}
+		mirrors = append(mirrors, expanded)
+	}
+	return sources, mirrors
+}
 
-		filename, _ := SplitSource(expandedSource)
-		sourcePath := filepath.Join(sourceDir, filename)
+// Prepares the build of the given recipe.  All of the recipe's dependencies
+// must have finished before this is called.
+func (ctx *context) setupBuild(name string) *buildSetup {
+	recipe := recipesRegistry[name]
+	info := recipe.Info()
 
-		// Unpack it.
-		if err := util.UnpackArchive(sourcePath, sourceDir); err != nil {
-			log.WithFields(logrus.Fields{
-				"recipe": name,
-				"source": expandedSource,
-				"err":    err,
-			}).Error("Could not unpack source")
-			return err
+	setup := &buildSetup{
+		Recipe:        recipe,
+		Info:          info,
+		SourceDir:     filepath.Join(ctx.config.BuildDir, name),
+		OutDir:        ctx.outDir(name, info),
+		StagingDir:    ctx.stagingDir(name),
+		SysrootDir:    filepath.Join(ctx.config.BuildDir, "sysroot", name),
+		DependencyEnv: make(map[string]map[string]string),
+		depKeys:       make(map[string]string),
+	}
+
+	setup.Sources, setup.Mirrors = expandSources(info)
+
+	setup.deps = linkOrder(name, ctx.config.Platform, ctx.config.Arch)
+
+	// Dependencies are installed into a sysroot specific to this recipe.
+	// Point the compiler and pkg-config at it, and ensure that pkg-config
+	// doesn't find anything from the host.
+	usrDir := filepath.Join(setup.SysrootDir, installPrefix)
+	env := addHostEnv(ctx.config, ctx.rootEnv, info.HostEnv)
+	setup.BaseEnv = ctx.recipeBaseEnv(info)
+	env = env.
+		Set("PKG_CONFIG_LIBDIR", strings.Join([]string{
+			filepath.Join(usrDir, "lib", "pkgconfig"),
+			filepath.Join(usrDir, "share", "pkgconfig"),
+		}, ":")).
+		Set("PKG_CONFIG_SYSROOT_DIR", setup.SysrootDir).
+		Delete("PKG_CONFIG_PATH")
+	if len(setup.deps) > 0 {
+		env = env.
+			Append("CPPFLAGS", " -I"+filepath.Join(usrDir, "include")+" ").
+			Append("LDFLAGS", " -L"+filepath.Join(usrDir, "lib")+" ")
+	}
+
+	// Add the flags for all libraries that this recipe depends on.  Since
+	// the dependencies are in link order, so are the libraries.
+	var libs []string
+	for _, dep := range setup.deps {
+		depInfo := recipesRegistry[dep].Info()
+		if !depInfo.Library {
+			continue
+		}
+
+		setup.ConfigureFlags = append(setup.ConfigureFlags, "--with-"+dep+"="+usrDir)
+		for _, dir := range depInfo.Exports.IncludeDirs {
+			env = env.Append("CPPFLAGS", " -I"+filepath.Join(usrDir, dir)+" ")
+		}
+		for _, dir := range depInfo.Exports.LibDirs {
+			env = env.Append("LDFLAGS", " -L"+filepath.Join(usrDir, dir)+" ")
+		}
+		for _, lib := range depInfo.Exports.Libs {
+			libs = append(libs, "-l"+lib)
 		}
 	}
+	if len(libs) > 0 {
+		setup.Libs = strings.Join(libs, " ")
+		env = env.Set("LIBS", setup.Libs)
+	}
 
-	// Make the environment for this build.  We do this by taking the root
-	// environment, and then merging in all flags from the recursive tree of
-	// dependencies.
-	deps := dependencyNames(name, ctx.config.Platform, ctx.config.Arch)
-	env := ctx.rootEnv
-	envMap := make(map[string]map[string]string)
-	for _, dep := range deps {
+	// Merge in all flags from the recursive tree of dependencies.
+	ctx.envLock.Lock()
+	for _, dep := range setup.deps {
 		if flags, ok := ctx.packageEnv[dep]; ok {
-			envMap[dep] = flags
+			setup.DependencyEnv[dep] = flags
 			for k, v := range flags {
 				env = env.Append(k, " "+v+" ")
 			}
 		}
 	}
+	for _, dep := range recipe.Dependencies(ctx.config.Platform, ctx.config.Arch) {
+		setup.depKeys[dep] = ctx.buildKeys[dep]
+	}
+	ctx.envLock.Unlock()
 
 	// Set up cross compiler environment.
 	prefix := CrossPrefix(ctx.config.Platform, ctx.config.Arch)
@@ -183,89 +380,630 @@ func buildOne(name string, ctx *context) error {
 	} else {
 		staticFlag = " -static "
 	}
+	staticFlag = hardenStaticFlags(ctx.config.Hardening, ctx.config.Platform, staticFlag)
 
-	// Set up the random seed we pass to each build.  This is a part of the
-	// compiler command to ensure that it gets passed correctly.
-	if DETERMINISTIC {
-		randomSeed := fmt.Sprintf(
-			" -frandom-seed=build-%s-%s-%s ",
-			name,
-			ctx.config.Platform,
-			ctx.config.Arch,
-		)
-		env = env.Append("CC", randomSeed).Append("CXX", randomSeed)
+	// Reproducible builds use a stable locale and timezone, which also
+	// applies when identifying the compiler.
+	if ctx.config.Reproducible {
+		env = env.Set("LC_ALL", "C").Set("TZ", "UTC")
 	}
 
-	// Run the build in this directory.
-	buildCtx := types.BuildContext{
-		SourceDir:     sourceDir,
-		Env:           env,
-		CrossPrefix:   prefix,
-		StaticFlags:   staticFlag,
-		Platform:      ctx.config.Platform,
-		Arch:          ctx.config.Arch,
-		DependencyEnv: envMap,
+	setup.compilerEnv = env
+
+	// Set up the flags that make reproducible builds independent of where
+	// they're built.  These are a part of the compiler command to ensure that
+	// they get passed correctly.
+	if ctx.config.Reproducible {
+		flags := reproducibleFlags(name, ctx.config)
+		env = env.Append("CC", flags).Append("CXX", flags)
 	}
 
-	if err := recipe.Prepare(&buildCtx); err != nil {
+	setup.Env = env
+	setup.CrossPrefix = prefix
+	setup.StaticFlags = staticFlag
+	return setup
+}
+
+// Returns a context that is cancelled after the given timeout, or only when
+// the parent is if the timeout is zero.
+func withTimeout(parent stdcontext.Context, timeout time.Duration) (stdcontext.Context, stdcontext.CancelFunc) {
+	if timeout > 0 {
+		return stdcontext.WithTimeout(parent, timeout)
+	}
+	return stdcontext.WithCancel(parent)
+}
+
+// Replaces an error caused by the recipe or phase timing out with one that
+// says which timeout expired.
+func (ctx *context) describeTimeout(err error, recipeCtx, phaseCtx stdcontext.Context) error {
+	switch {
+	case recipeCtx.Err() == stdcontext.DeadlineExceeded:
+		return fmt.Errorf("recipe timed out after %s", ctx.config.RecipeTimeout)
+	case phaseCtx.Err() == stdcontext.DeadlineExceeded:
+		return fmt.Errorf("phase timed out after %s", ctx.config.PhaseTimeout)
+	}
+	return err
+}
+
+// Writes a status line for the given recipe, if the configuration asks for
+// them.
+func (ctx *context) status(name, msg string) {
+	if ctx.config.Status == nil {
+		return
+	}
+
+	fmt.Fprintf(ctx.config.Status, "[%s/%s] %-20s %s\n",
+		ctx.config.Platform, ctx.config.Arch, name, msg)
+}
+
+// Returns the directory that the given recipe installs files into.
+func (ctx *context) stagingDir(name string) string {
+	return filepath.Join(ctx.config.BuildDir, "staging", name)
+}
+
+// Returns the directory that the given recipe's outputs are written to.
+func (ctx *context) outDir(name string, info *types.RecipeInfo) string {
+	return filepath.Join(ctx.config.OutputDir, name, info.Version)
+}
+
+// Returns the variables that the given recipe's environment is based on, if
+// the build is hermetic, or nil otherwise.
+func (ctx *context) recipeBaseEnv(info *types.RecipeInfo) map[string]string {
+	if !ctx.config.Hermetic {
+		return nil
+	}
+	return envMap(addHostEnv(ctx.config, ctx.rootEnv, info.HostEnv))
+}
+
+// Assembles the sysroot for the given build from the staging directories of
+// all of its dependencies.
+func (ctx *context) assembleSysroot(setup *buildSetup) error {
+	if err := os.RemoveAll(setup.SysrootDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(setup.SysrootDir, 0700); err != nil {
+		return err
+	}
+
+	for _, dep := range setup.deps {
+		staging := ctx.stagingDir(dep)
+		if _, err := os.Stat(staging); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := copyTree(staging, setup.SysrootDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes libtool archives from a staging directory.  These contain absolute
+// paths to the installed libraries (i.e. outside the sysroot), and would cause
+// dependents to link against libraries from the host.
+func removeLibtoolArchives(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".la") {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// Returns the key for the given build, which is a hash of all of its inputs.
+func (ctx *context) buildKey(setup *buildSetup) (string, error) {
+	toolchain, err := ctx.toolchainID(setup.compilerEnv)
+	if err != nil {
+		return "", err
+	}
+
+	inputs := buildInputs{
+		Recipe:       setup.Recipe,
+		DepKeys:      setup.depKeys,
+		Platform:     ctx.config.Platform,
+		Arch:         ctx.config.Arch,
+		CrossPrefix:  setup.CrossPrefix,
+		StaticFlags:  setup.StaticFlags,
+		Reproducible: ctx.config.Reproducible,
+		BaseEnv:      setup.BaseEnv,
+		Toolchain:    toolchain,
+		SharedAssets: sharedAssets(),
+	}
+	return inputs.Key(), nil
+}
+
+func buildOne(name string, ctx *context) error {
+	// Don't start anything new once the build has been cancelled.
+	if err := ctx.runCtx.Err(); err != nil {
+		return err
+	}
+
+	log.WithField("recipe", name).Info("Building single recipe")
+	start := time.Now()
+	setup := ctx.setupBuild(name)
+
+	recipeCtx, cancel := withTimeout(ctx.runCtx, ctx.config.RecipeTimeout)
+	defer cancel()
+	recipe, info := setup.Recipe, setup.Info
+	sourceDir, outDir := setup.SourceDir, setup.OutDir
+
+	key, err := ctx.buildKey(setup)
+	if err != nil {
 		log.WithFields(logrus.Fields{
 			"recipe": name,
+			"cc":     setup.compilerEnv.Get("CC"),
 			"err":    err,
-		}).Error("Prepare failed")
+		}).Error("Could not identify toolchain")
 		return err
 	}
-	if err := recipe.Build(&buildCtx); err != nil {
+
+	// If we've already finished a build with exactly the same inputs, we can
+	// reuse it instead of building again.
+	var rec *buildRecord
+	if !ctx.force[name] {
+		rec, err = ctx.builds.Lookup(key)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"key":    key,
+				"err":    err,
+			}).Warn("Could not read cached build")
+		}
+	}
+	if rec != nil {
 		log.WithFields(logrus.Fields{
 			"recipe": name,
-			"err":    err,
-		}).Error("Build failed")
+			"key":    key,
+		}).Info("Recipe is up to date, using cached build")
+
+		if err := ctx.builds.Restore(rec, outDir, setup.StagingDir); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"outDir": outDir,
+				"err":    err,
+			}).Error("Could not restore cached outputs")
+			return err
+		}
+
+		ctx.recordFinish(name, key, rec.Env)
+		ctx.finishBuild(name, key, rec.Env)
+		ctx.report.Finish(name, StatusCached, key, rec.Env)
+		ctx.status(name, "up to date")
+		return nil
+	}
+
+	// If we're resuming a previous run of this exact build, we skip all the
+	// phases that it completed.  Otherwise, we start from scratch.
+	var done *journalEntry
+	if ctx.config.Resume {
+		if entry := ctx.journal.Entry(name); entry != nil && entry.Key == key {
+			done = entry
+		}
+	}
+	if done == nil {
+		done = &journalEntry{Key: key}
+		if err := ctx.journal.Start(name, key); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"err":    err,
+			}).Warn("Could not update build journal")
+		}
+	} else {
+		log.WithFields(logrus.Fields{
+			"recipe": name,
+			"phases": done.Phases,
+		}).Info("Resuming previous build")
+	}
+
+	if done.Completed(phaseFinalize) {
+		ctx.finishBuild(name, key, done.Env)
+		ctx.report.Finish(name, StatusAlreadyBuilt, key, done.Env)
+		ctx.status(name, "already built")
+		return nil
+	}
+
+	if !done.Completed(phaseFetch) {
+		phaseStart := time.Now()
+		fetchCtx, cancel := withTimeout(recipeCtx, ctx.config.PhaseTimeout)
+		defer cancel()
+
+		// Remove and re-create the source directory for this build.
+		if err := os.RemoveAll(sourceDir); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"err":    err,
+			}).Error("Could not remove source directory")
+			return err
+		}
+		if err := os.Mkdir(sourceDir, 0700); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"err":    err,
+			}).Error("Could not create source directory")
+			return err
+		}
+
+		for i, expandedSource := range setup.Sources {
+			if err := ctx.cache.Fetch(
+				fetchCtx,
+				name,
+				expandedSource,
+				setup.Mirrors[i],
+				info.Sums[i],
+				sourceDir,
+			); err != nil {
+				log.WithFields(logrus.Fields{
+					"recipe": name,
+					"source": expandedSource,
+					"hash":   info.Sums[i],
+					"err":    err,
+				}).Error("Could not fetch source")
+				return ctx.describeTimeout(err, recipeCtx, fetchCtx)
+			}
+		}
+		ctx.recordPhase(name, phaseFetch)
+		ctx.report.Phase(name, phaseFetch, time.Since(phaseStart))
+	}
+
+	if !done.Completed(phaseUnpack) {
+		phaseStart := time.Now()
+		unpackCtx, cancel := withTimeout(recipeCtx, ctx.config.PhaseTimeout)
+		defer cancel()
+		for _, expandedSource := range setup.Sources {
+			filename, _ := SplitSource(expandedSource)
+			sourcePath := filepath.Join(sourceDir, filename)
+
+			if err := util.UnpackArchive(unpackCtx, sourcePath, sourceDir); err != nil {
+				log.WithFields(logrus.Fields{
+					"recipe": name,
+					"source": expandedSource,
+					"err":    err,
+				}).Error("Could not unpack source")
+				return ctx.describeTimeout(err, recipeCtx, unpackCtx)
+			}
+		}
+
+		// The date of the sources has to be found before any other phase can
+		// modify them.
+		if ctx.config.Reproducible {
+			epoch, err := sourceDateEpoch(info, sourceDir)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"recipe": name,
+					"err":    err,
+				}).Error("Could not find date of sources")
+				return err
+			}
+
+			done.SourceDateEpoch = epoch
+			if err := ctx.journal.SetSourceDateEpoch(name, epoch); err != nil {
+				log.WithFields(logrus.Fields{
+					"recipe": name,
+					"err":    err,
+				}).Warn("Could not update build journal")
+			}
+		}
+		ctx.recordPhase(name, phaseUnpack)
+		ctx.report.Phase(name, phaseUnpack, time.Since(phaseStart))
+	}
+
+	if err := ctx.assembleSysroot(setup); err != nil {
+		log.WithFields(logrus.Fields{
+			"recipe":  name,
+			"sysroot": setup.SysrootDir,
+			"err":     err,
+		}).Error("Could not assemble sysroot")
 		return err
 	}
 
+	if ctx.config.Reproducible {
+		setup.Env = setup.Env.Set("SOURCE_DATE_EPOCH", strconv.FormatInt(done.SourceDateEpoch, 10))
+	}
+
+	// The output of every command run by the recipe goes to a log file for
+	// each phase, and optionally to the status output.
+	var echo io.Writer
+	if ctx.config.Verbose {
+		echo = ctx.config.Status
+	}
+	logs := newRecipeLog(filepath.Join(ctx.config.LogsDir(), name), setup.Env, echo)
+	if ctx.config.Sandbox {
+		logs.mounts = ctx.sandboxMounts(setup)
+	}
+
+	// Run the build in this directory.
+	buildCtx := types.BuildContext{
+		SourceDir:      sourceDir,
+		Env:            setup.Env,
+		CrossPrefix:    setup.CrossPrefix,
+		Prefix:         installPrefix,
+		StagingDir:     setup.StagingDir,
+		SysrootDir:     setup.SysrootDir,
+		ConfigureFlags: setup.ConfigureFlags,
+		Libs:           setup.Libs,
+		StaticFlags:    setup.StaticFlags,
+		Platform:       ctx.config.Platform,
+		Arch:           ctx.config.Arch,
+		DependencyEnv:  setup.DependencyEnv,
+		Run:            logs.Run,
+	}
+
+	// Runs a single phase of the recipe, logging its output.
+	runPhase := func(p phase, fn func() error) error {
+		phaseCtx, cancel := withTimeout(recipeCtx, ctx.config.PhaseTimeout)
+		defer cancel()
+
+		if err := logs.Begin(phaseCtx, p); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"err":    err,
+			}).Error("Could not create log file")
+			return err
+		}
+
+		buildCtx.Context = phaseCtx
+		phaseStart := time.Now()
+		err := fn()
+		logs.End()
+		ctx.report.Phase(name, p, time.Since(phaseStart))
+		if err != nil {
+			err = ctx.describeTimeout(err, recipeCtx, phaseCtx)
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"phase":  p,
+				"log":    logs.Path(p),
+				"err":    err,
+			}).Error("Phase failed")
+			return &PhaseError{
+				Recipe:  name,
+				Phase:   string(p),
+				LogPath: logs.Path(p),
+				Err:     err,
+			}
+		}
+		return nil
+	}
+
+	if !done.Completed(phasePrepare) {
+		if err := runPhase(phasePrepare, func() error {
+			return recipe.Prepare(&buildCtx)
+		}); err != nil {
+			return err
+		}
+		ctx.recordPhase(name, phasePrepare)
+	}
+	if !done.Completed(phaseBuild) {
+		if err := runPhase(phaseBuild, func() error {
+			return recipe.Build(&buildCtx)
+		}); err != nil {
+			return err
+		}
+		ctx.recordPhase(name, phaseBuild)
+	}
+
 	// Now, fill in the environment variable function.
+	exported := make(map[string]string)
 	buildCtx.AddDependentEnvVar = func(key, value string) {
-		mm, ok := ctx.packageEnv[name]
-		if !ok {
-			mm = make(map[string]string)
-			ctx.packageEnv[name] = mm
+		exported[key] = value
+	}
+
+	// Create the output and staging directories for this recipe.  Anything
+	// left over from a previous build is removed, so that the cached copies
+	// only contain files from this build.
+	for _, dir := range []string{outDir, setup.StagingDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"dir":    dir,
+				"err":    err,
+			}).Error("Could not remove directory")
+			return err
 		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"dir":    dir,
+				"err":    err,
+			}).Error("Could not create directory")
+			return err
+		}
+	}
 
-		mm[key] = value
+	if err := runPhase(phaseFinalize, func() error {
+		return recipe.Finalize(&buildCtx, outDir)
+	}); err != nil {
+		return err
 	}
 
-	// Create the output directory for this recipe.
-	outDir := filepath.Join(
-		ctx.config.OutputDir,
-		name,
-		info.Version,
-	)
-	if err := os.MkdirAll(outDir, 0755); err != nil {
+	if err := removeLibtoolArchives(setup.StagingDir); err != nil {
 		log.WithFields(logrus.Fields{
 			"recipe": name,
-			"outDir": outDir,
 			"err":    err,
-		}).Error("Could not create output directory")
+		}).Error("Could not clean up staging directory")
 		return err
 	}
 
-	if err := recipe.Finalize(&buildCtx, outDir); err != nil {
+	// Ensure that the outputs are static binaries for the right target.
+	if err := ctx.verify(name, outDir, logs); err != nil {
+		return err
+	}
+
+	// Check that the outputs actually work, if they can run here.
+	if ctx.hasTests(recipe) {
+		if err := runPhase(phaseTest, func() error {
+			return ctx.runTests(name, recipe, &buildCtx, outDir, logs)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Save this build so that it can be reused later.  Failing to do so
+	// isn't fatal, since the build itself succeeded.
+	rec = &buildRecord{
+		Name:    name,
+		Version: info.Version,
+		Key:     key,
+		Env:     exported,
+	}
+	if err := ctx.builds.Store(rec, outDir, setup.StagingDir); err != nil {
 		log.WithFields(logrus.Fields{
 			"recipe": name,
+			"key":    key,
 			"err":    err,
-		}).Error("Finalize failed")
-		return err
+		}).Warn("Could not save build to cache")
 	}
 
+	ctx.recordFinish(name, key, exported)
+	ctx.finishBuild(name, key, exported)
+	ctx.report.Finish(name, StatusBuilt, key, exported)
+	ctx.status(name, "built in "+time.Since(start).Round(time.Second).String())
 	return nil
 }
 
+// Records the completion of a phase in the journal.  Failing to do so only
+// means that the phase will be re-run when resuming, so it is not fatal.
+func (ctx *context) recordPhase(name string, p phase) {
+	if err := ctx.journal.Complete(name, p); err != nil {
+		log.WithFields(logrus.Fields{
+			"recipe": name,
+			"phase":  p,
+			"err":    err,
+		}).Warn("Could not update build journal")
+	}
+}
+
+// Records a finished build of a recipe in the journal.
+func (ctx *context) recordFinish(name, key string, exported map[string]string) {
+	if err := ctx.journal.Finish(name, key, exported); err != nil {
+		log.WithFields(logrus.Fields{
+			"recipe": name,
+			"err":    err,
+		}).Warn("Could not update build journal")
+	}
+}
+
+// Marks a recipe as finished using the results recorded in the journal,
+// without building it.
+func (ctx *context) reuseRecorded(name string) error {
+	entry := ctx.journal.Entry(name)
+	if entry == nil || !entry.Completed(phaseFinalize) {
+		log.WithField("recipe", name).Error("No recorded build to reuse")
+		return fmt.Errorf("builder: recipe %s has no recorded build to reuse", name)
+	}
+
+	log.WithField("recipe", name).Info("Reusing recorded build")
+	ctx.finishBuild(name, entry.Key, entry.Env)
+	ctx.report.Finish(name, StatusReused, entry.Key, entry.Env)
+	return nil
+}
+
+// Records that the given recipe has finished building, making its key and
+// exported environment variables available to its dependents.
+func (ctx *context) finishBuild(name, key string, exported map[string]string) {
+	ctx.envLock.Lock()
+	defer ctx.envLock.Unlock()
+
+	ctx.buildKeys[name] = key
+	if len(exported) > 0 {
+		ctx.packageEnv[name] = exported
+	}
+}
+
+// Returns the identity of the compiler named by the given environment.  Each
+// compiler is only inspected once per build.
+func (ctx *context) toolchainID(e *env.Env) (string, error) {
+	cc := e.Get("CC")
+
+	ctx.envLock.Lock()
+	id, ok := ctx.toolchains[cc]
+	ctx.envLock.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	id, err := toolchainID(ctx.runCtx, e)
+	if err != nil {
+		return "", err
+	}
+
+	ctx.envLock.Lock()
+	ctx.toolchains[cc] = id
+	ctx.envLock.Unlock()
+	return id, nil
+}
+
+// Returns the set of recipes in the graph that should be built, given the
+// recipes to build from and the recipes to build exclusively.  Returns nil if
+// every recipe should be built.
+func selectRecipes(depgraph graph, from, only []string) (map[string]bool, error) {
+	if len(from) > 0 && len(only) > 0 {
+		return nil, fmt.Errorf("builder: cannot specify both 'from' and 'only' recipes")
+	}
+	if len(from) == 0 && len(only) == 0 {
+		return nil, nil
+	}
+
+	for _, names := range [][]string{from, only} {
+		for _, name := range names {
+			if _, found := depgraph[name]; !found {
+				return nil, fmt.Errorf("builder: recipe %s is not part of this build", name)
+			}
+		}
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range only {
+		selected[name] = true
+	}
+
+	// When building 'from' a recipe, we also rebuild everything that
+	// depends on it.
+	var visit func(string)
+	visit = func(name string) {
+		if selected[name] {
+			return
+		}
+		selected[name] = true
+
+		for _, dependent := range depgraph[name] {
+			visit(dependent)
+		}
+	}
+	for _, name := range from {
+		visit(name)
+	}
+
+	return selected, nil
+}
+
 // Returns a sorted list of dependencies for the given recipe name, or an error
 // describing a dependency cycle.
 func getRecipeDeps(recipes []string, platform, arch string) ([]string, error) {
+	depgraph, err := recipeGraph(recipes, platform, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortGraph(depgraph)
+}
+
+// Returns the dependency graph for the given recipes, mapping each recipe to
+// the recipes that directly depend on it.
+func recipeGraph(recipes []string, platform, arch string) (graph, error) {
 	depgraph := make(graph)
+	visited := make(map[string]bool)
 
 	var visit func(string) error
 	visit = func(curr string) error {
+		if visited[curr] {
+			return nil
+		}
+		visited[curr] = true
+
 		recipe, found := recipesRegistry[curr]
 		if !found {
 			return fmt.Errorf("builder: recipe %s does not exist", curr)
@@ -290,7 +1028,12 @@ func getRecipeDeps(recipes []string, platform, arch string) ([]string, error) {
 		}
 	}
 
-	// Toplogically sort dependencies
+	return depgraph, nil
+}
+
+// Topologically sorts the given dependency graph, returning an error that
+// describes a dependency cycle if one exists.
+func sortGraph(depgraph graph) ([]string, error) {
 	order, cycle := topologicalSort(depgraph)
 	if len(cycle) > 0 {
 		return nil, fmt.Errorf("builder: dependency cycle detected: %+v", cycle)
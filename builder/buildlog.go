@@ -0,0 +1,269 @@
+package builder
+
+import (
+	"bufio"
+	stdcontext "context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrew-d/sbuild/env"
+	"github.com/andrew-d/sbuild/sandbox"
+	"github.com/andrew-d/sbuild/util"
+)
+
+// PhaseError is returned when one of the phases of a recipe's build fails.
+type PhaseError struct {
+	Recipe string
+	Phase  string
+
+	// The log file containing the output of the failed phase.
+	LogPath string
+
+	Err error
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("%s: %s failed: %s", e.Recipe, e.Phase, e.Err)
+}
+
+// recipeLog captures the output of all commands run while building a single
+// recipe, in one file per phase.
+type recipeLog struct {
+	dir     string
+	baseEnv []string
+
+	// If non-nil, all output is also copied here.
+	echo io.Writer
+
+	// If non-nil, commands are run in a sandbox with these mounts.
+	mounts *sandbox.Mounts
+
+	// The log file and context for the current phase.
+	lock   sync.Mutex
+	f      *os.File
+	runCtx stdcontext.Context
+}
+
+func newRecipeLog(dir string, baseEnv *env.Env, echo io.Writer) *recipeLog {
+	return &recipeLog{
+		dir:     dir,
+		baseEnv: baseEnv.AsSlice(),
+		echo:    echo,
+	}
+}
+
+// Path returns the path of the log file for the given phase.
+func (l *recipeLog) Path(p phase) string {
+	return filepath.Join(l.dir, string(p)+".log")
+}
+
+// Begin starts logging the given phase, replacing any previous log for it.
+// Commands run during the phase are stopped if the context is cancelled.
+func (l *recipeLog) Begin(runCtx stdcontext.Context, p phase) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(l.Path(p))
+	if err != nil {
+		return err
+	}
+
+	l.f = f
+	l.runCtx = runCtx
+	return nil
+}
+
+// End finishes logging the current phase.
+func (l *recipeLog) End() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+	l.runCtx = nil
+	return err
+}
+
+// Printf writes a message to the log for the current phase.
+func (l *recipeLog) Printf(format string, args ...interface{}) {
+	l.lock.Lock()
+	f := l.f
+	l.lock.Unlock()
+
+	if f == nil {
+		return
+	}
+	fmt.Fprintf(f, format, args...)
+	if l.echo != nil {
+		fmt.Fprintf(l.echo, format, args...)
+	}
+}
+
+// Run runs the given command, writing a header describing it and all of its
+// output to the log for the current phase.  The command's output is only
+// captured if its Stdout or Stderr are not already set, and it runs in the
+// recipe's environment unless its Env is set.
+func (l *recipeLog) Run(cmd *exec.Cmd) error {
+	return l.RunIn(cmd, l.mounts)
+}
+
+// RunIn is like Run, but runs the command in a sandbox with the given mounts
+// instead of the recipe's, or without a sandbox if they're nil.
+func (l *recipeLog) RunIn(cmd *exec.Cmd, mounts *sandbox.Mounts) error {
+	l.lock.Lock()
+	f, runCtx := l.f, l.runCtx
+	l.lock.Unlock()
+
+	if f == nil {
+		return fmt.Errorf("builder: command run outside of a build phase: %s",
+			strings.Join(cmd.Args, " "))
+	}
+
+	var out io.Writer = f
+	if l.echo != nil {
+		out = io.MultiWriter(f, l.echo)
+	}
+
+	// Commands must never inherit sbuild's own environment, which a nil Env
+	// would do even if the recipe's environment is empty.
+	if cmd.Env == nil {
+		cmd.Env = append(make([]string, 0, len(l.baseEnv)), l.baseEnv...)
+	}
+
+	l.writeHeader(out, cmd, mounts != nil)
+	if cmd.Stdout == nil {
+		cmd.Stdout = out
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = out
+	}
+
+	run := cmd
+	if mounts != nil {
+		var err error
+		if run, err = sandbox.Command(cmd, mounts); err != nil {
+			fmt.Fprintf(out, "==> Could not create sandbox: %s\n", err)
+			return err
+		}
+	}
+
+	err := util.RunCommand(runCtx, run)
+	if err != nil {
+		fmt.Fprintf(out, "==> Command failed: %s\n", err)
+	}
+	return err
+}
+
+// Writes a header describing the given command: when it was run, its
+// arguments, working directory, and how its environment differs from the
+// recipe's.
+func (l *recipeLog) writeHeader(w io.Writer, cmd *exec.Cmd, sandboxed bool) {
+	dir := cmd.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = quoteArg(arg)
+	}
+
+	fmt.Fprintf(w, "==> %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "    argv: %s\n", strings.Join(args, " "))
+	fmt.Fprintf(w, "    cwd:  %s\n", dir)
+	if sandboxed {
+		fmt.Fprintf(w, "    (sandboxed)\n")
+	}
+
+	for _, line := range envDiff(l.baseEnv, cmd.Env) {
+		fmt.Fprintf(w, "    env:  %s\n", line)
+	}
+	fmt.Fprintln(w)
+}
+
+// Quotes a command-line argument if it contains anything that the shell would
+// interpret.
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`*?;&|<>()") {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
+
+// Returns the differences between two environments, in "KEY=value" form, as
+// sorted lines of the form "+KEY=value" (added or changed) and "-KEY"
+// (removed).
+func envDiff(base, other []string) []string {
+	toMap := func(vars []string) map[string]string {
+		ret := make(map[string]string, len(vars))
+		for _, v := range vars {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) == 2 {
+				ret[parts[0]] = parts[1]
+			} else {
+				ret[parts[0]] = ""
+			}
+		}
+		return ret
+	}
+
+	baseMap, otherMap := toMap(base), toMap(other)
+
+	var ret []string
+	for k, v := range otherMap {
+		if old, ok := baseMap[k]; !ok || old != v {
+			ret = append(ret, "+"+k+"="+v)
+		}
+	}
+	for k := range baseMap {
+		if _, ok := otherMap[k]; !ok {
+			ret = append(ret, "-"+k)
+		}
+	}
+
+	// Sort by variable name, ignoring the leading '+' or '-'.
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i][1:] < ret[j][1:]
+	})
+	return ret
+}
+
+// LogTail returns the last n lines of the given log file.
+func LogTail(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,84 @@
+package builder
+
+import (
+	stdcontext "context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/env"
+)
+
+func TestEnvDiff(t *testing.T) {
+	diff := envDiff(
+		[]string{"A=1", "B=2", "C=3"},
+		[]string{"C=3", "B=changed", "D=4"},
+	)
+	assert.Equal(t, []string{"-A", "+B=changed", "+D=4"}, diff)
+}
+
+func TestRecipeLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logs := newRecipeLog(dir, env.Empty().Set("FOO", "bar"), nil)
+
+	// Commands can only be run during a phase.
+	assert.Error(t, logs.Run(exec.Command("true")))
+
+	require.NoError(t, logs.Begin(stdcontext.Background(), phaseBuild))
+
+	// Commands that don't set their own environment get the recipe's.
+	assert.NoError(t, logs.Run(exec.Command("sh", "-c", "echo FOO is $FOO")))
+
+	cmd := exec.Command("sh", "-c", "echo hello; echo oops >&2; exit 3")
+	cmd.Dir = dir
+	cmd.Env = []string{"FOO=baz"}
+	assert.Error(t, logs.Run(cmd))
+	require.NoError(t, logs.End())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "build.log"))
+	require.NoError(t, err)
+	out := string(data)
+
+	assert.Contains(t, out, `argv: sh -c "echo hello; echo oops >&2; exit 3"`)
+	assert.Contains(t, out, "cwd:  "+dir)
+	assert.Contains(t, out, "env:  +FOO=baz")
+	assert.Contains(t, out, "hello\noops\n")
+	assert.Contains(t, out, "Command failed")
+	assert.Contains(t, out, "FOO is bar\n")
+	assert.NotContains(t, out, "inherited")
+
+	lines, err := LogTail(logs.Path(phaseBuild), 2)
+	require.NoError(t, err)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "oops", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "==> Command failed"))
+}
+
+func TestRecipeLogEmptyEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("SBUILD_TEST_HOST_VAR", "from-host")
+	defer os.Unsetenv("SBUILD_TEST_HOST_VAR")
+
+	// An empty environment is still not sbuild's.
+	logs := newRecipeLog(dir, env.Empty(), nil)
+	require.NoError(t, logs.Begin(stdcontext.Background(), phaseBuild))
+	cmd := exec.Command("/bin/sh", "-c", "echo host var is ${SBUILD_TEST_HOST_VAR:-unset}")
+	assert.NoError(t, logs.Run(cmd))
+	require.NoError(t, logs.End())
+
+	data, err := ioutil.ReadFile(logs.Path(phaseBuild))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "host var is unset\n")
+}
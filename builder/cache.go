@@ -1,127 +1,320 @@
 package builder
 
 import (
+	stdcontext "context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
+
+	"github.com/andrew-d/sbuild/config"
 )
 
+// The directory in the cache that holds the content of every source, named
+// by its SHA-256 hash.  Sources are shared between recipes by content, and
+// the recipe/filename layout only holds symlinks to them.
+const contentDir = "sha256"
+
 type sourceCache struct {
-	rootDir string
+	rootDir    string
+	downloader *downloader
+	rewrites   []config.URLRewrite
+
+	// If set, nothing is downloaded, and only sources that are already in
+	// the cache can be fetched.
+	offline bool
+
+	// Per-file locks, so that concurrent builds don't download or verify the
+	// same cached file at the same time.
+	locks     map[string]*sync.Mutex
+	locksLock sync.Mutex
 }
 
-func newSourceCache(rootDir string) (*sourceCache, error) {
+func newSourceCache(rootDir string, rewrites []config.URLRewrite) (*sourceCache, error) {
 	ret := &sourceCache{
-		rootDir: rootDir,
+		rootDir:    rootDir,
+		downloader: newDownloader(),
+		rewrites:   rewrites,
+		locks:      make(map[string]*sync.Mutex),
 	}
 	return ret, nil
 }
 
+// Locks the given path in the cache, returning a function that unlocks it.
+func (c *sourceCache) lockPath(path string) func() {
+	c.locksLock.Lock()
+	l, ok := c.locks[path]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[path] = l
+	}
+	c.locksLock.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Returns the path in the cache that holds the content with the given hash.
+func (c *sourceCache) contentPath(hash string) string {
+	return filepath.Join(c.rootDir, contentDir, strings.ToLower(hash))
+}
+
+// Returns the path in the cache of the given recipe's view of a source.
+func (c *sourceCache) viewPath(recipe, filename string) string {
+	return filepath.Join(c.rootDir, recipe, filename)
+}
+
 // Fetch will attempt to download the given source, and verify that it matches
 // the provided hash.  If fetching succeeds, it will symlink the downloaded
-// source into the given directory.  If a source for a given package has
-// already been downloaded, then it will not be downloaded a second time.  If a
-// source fails hash verification, then any cached source will be removed (so
-// it will be re-downloaded upon the next attempt).
-func (c *sourceCache) Fetch(recipe, source, hash, intoDir string) error {
+// source into the given directory.  If a source with the same hash has
+// already been downloaded, for any recipe and under any filename, then it
+// will not be downloaded a second time.  Downloads are only added to the
+// cache once they match the hash, and if a cached source fails hash
+// verification, then it will be removed (so it will be re-downloaded upon the
+// next attempt).  If the source can't be downloaded from its URL, the given
+// mirrors are tried in order, and URL rewrite rules are applied to all of
+// them.  Downloads are stopped if the context is cancelled.
+func (c *sourceCache) Fetch(runCtx stdcontext.Context, recipe, source string, mirrors []string, hash, intoDir string) error {
+	if _, err := c.Ensure(runCtx, recipe, source, mirrors, hash); err != nil {
+		return err
+	}
+
 	filename, source := SplitSource(source)
-	recipeCacheDir := filepath.Join(c.rootDir, recipe)
-	filePath := filepath.Join(recipeCacheDir, filename)
+	filePath := c.contentPath(hash)
 
-	// Ensure the cache dir exists.
-	if err := os.Mkdir(recipeCacheDir, 0700); err != nil {
-		if !os.IsExist(err) {
-			return err
+	// Symlink the file from the cache directory into the source directory.
+	if err := os.Symlink(filePath, filepath.Join(intoDir, filename)); err != nil {
+		log.WithFields(logrus.Fields{
+			"recipe":  recipe,
+			"source":  source,
+			"err":     err,
+			"oldname": filePath,
+			"newname": filepath.Join(intoDir, filename),
+		}).Error("Could not symlink")
+		return err
+	}
+
+	return nil
+}
+
+// Ensure makes sure that the given source is in the cache and matches the
+// provided hash, downloading it if necessary, in the same way as Fetch.
+// Returns whether the source was downloaded.
+//
+// Sources are looked up by hash first.  A source that is only in the cache
+// under the old recipe/filename layout is moved to its hash, leaving a
+// symlink behind.
+func (c *sourceCache) Ensure(runCtx stdcontext.Context, recipe, source string, mirrors []string, hash string) (bool, error) {
+	filename, source := SplitSource(source)
+	filePath := c.contentPath(hash)
+	viewPath := c.viewPath(recipe, filename)
+
+	// Ensure the cache dirs exist.
+	for _, dir := range []string{filepath.Dir(filePath), filepath.Dir(viewPath)} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			if !os.IsExist(err) {
+				return false, err
+			}
 		}
 	}
 
-	// If the source already exists, then we don't need to download it.
+	// Move a source that's cached under the old layout first, since it needs
+	// the lock for its own hash, and we never hold more than one at a time.
+	if err := c.migrate(recipe, viewPath); err != nil {
+		return false, err
+	}
+
+	unlock := c.lockPath(filePath)
+	defer unlock()
+
+	downloaded := false
 	_, err := os.Stat(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// File does not exist.  Fetch it.
+	switch {
+	case err == nil:
+		log.WithFields(logrus.Fields{
+			"recipe": recipe,
+			"source": source,
+		}).Info("Source exists in cache")
+
+		// Hash the cached file and compare it against the given hash.
+		if err := c.compareHash(filePath, hash); err != nil {
+			// TODO: make configurable
+			os.Remove(filePath)
+			return false, err
+		}
+
+	case !os.IsNotExist(err):
+		// An actual error - return.
+		return false, err
+
+	default:
+		// File does not exist.  Fetch it, which also verifies it.
+		if c.offline {
+			err := fmt.Errorf("source %s is not in the cache, and downloads are disabled", filename)
 			log.WithFields(logrus.Fields{
 				"recipe": recipe,
 				"source": source,
-			}).Info("Fetching source")
-			if err := c.download(source, filePath); err != nil {
-				log.WithFields(logrus.Fields{
-					"recipe": recipe,
-					"source": source,
-					"err":    err,
-				}).Error("Error fetching source")
-				return err
-			}
-		} else {
-			// An actual error - return.
-			return err
+				"err":    err,
+			}).Error("Error fetching source")
+			return false, err
 		}
-	} else {
+
 		log.WithFields(logrus.Fields{
 			"recipe": recipe,
 			"source": source,
-		}).Info("Source exists in cache")
+		}).Info("Fetching source")
+		urls := sourceURLs(source, mirrors, c.rewrites)
+		if err := c.download(runCtx, recipe, urls, hash, filePath); err != nil {
+			log.WithFields(logrus.Fields{
+				"recipe": recipe,
+				"source": source,
+				"err":    err,
+			}).Error("Error fetching source")
+			return false, err
+		}
+		downloaded = true
 	}
 
-	// If we get here, then the source file should exist.  We hash the file and
-	// compare it against the given hash.
-	if err := c.compareHash(filePath, hash); err != nil {
-		// TODO: make configurable
-		os.Remove(filePath)
-		return err
+	if err := c.link(viewPath, filePath); err != nil {
+		return false, err
 	}
+	return downloaded, nil
+}
 
-	// Symlink the file from the cache directory into the source directory.
-	if err := os.Symlink(filePath, filepath.Join(intoDir, filename)); err != nil {
-		log.WithFields(logrus.Fields{
-			"recipe":  recipe,
-			"source":  source,
-			"err":     err,
-			"oldname": filePath,
-			"newname": filepath.Join(intoDir, filename),
-		}).Error("Could not symlink")
+// Moves a source that was cached under the old recipe/filename layout, if
+// there is one, to the path for its content, leaving a symlink behind.  The
+// file is moved whatever its hash is, since another recipe might need it.
+func (c *sourceCache) migrate(recipe, viewPath string) error {
+	if fi, err := os.Lstat(viewPath); err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	actual, err := fileHash(viewPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 
-	return nil
-}
+	filePath := c.contentPath(actual)
+	unlock := c.lockPath(filePath)
+	defer unlock()
 
-func (c *sourceCache) download(url, intoPath string) error {
-	cmd := exec.Command(
-		"curl",
-		"-L",
-		"-o", intoPath,
-		url,
-	)
-	cmd.Env = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+	// Another build may have moved the file while we were hashing it.
+	if fi, err := os.Lstat(viewPath); err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	log.WithFields(logrus.Fields{
+		"recipe": recipe,
+		"file":   filepath.Base(viewPath),
+		"hash":   actual,
+	}).Info("Migrating cached source")
+	if err := os.Rename(viewPath, filePath); err != nil {
+		return err
+	}
+	return c.link(viewPath, filePath)
 }
 
-func (c *sourceCache) compareHash(path, hash string) error {
-	f, err := os.Open(path)
+// Points the symlink at the given path in the cache at the given content,
+// replacing whatever was there.
+func (c *sourceCache) link(viewPath, filePath string) error {
+	target, err := filepath.Rel(filepath.Dir(viewPath), filePath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if existing, err := os.Readlink(viewPath); err == nil && existing == target {
+		return nil
+	}
 
-	hasher := sha256.New()
-	_, err = io.Copy(hasher, f)
-	if err != nil {
+	tmpPath := viewPath + ".tmp"
+	os.Remove(tmpPath)
+	if err := os.Symlink(target, tmpPath); err != nil {
 		return err
 	}
+	return os.Rename(tmpPath, viewPath)
+}
+
+// Contains returns whether the given source has already been downloaded into
+// the cache and matches the provided hash.  Unlike Ensure, it doesn't change
+// the cache, so sources under the old layout are checked where they are.
+func (c *sourceCache) Contains(recipe, source, hash string) bool {
+	filePath := c.contentPath(hash)
+
+	unlock := c.lockPath(filePath)
+	defer unlock()
+
+	if _, err := os.Stat(filePath); err == nil {
+		return c.compareHash(filePath, hash) == nil
+	}
+
+	filename, _ := SplitSource(source)
+	viewPath := c.viewPath(recipe, filename)
+	if fi, err := os.Lstat(viewPath); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	return c.compareHash(viewPath, hash) == nil
+}
+
+// Downloads a file from the first of the given URLs that works and matches
+// the given hash.
+func (c *sourceCache) download(runCtx stdcontext.Context, recipe string, urls []string, hash, path string) error {
+	var err error
+	for _, url := range urls {
+		err = c.downloader.Download(runCtx, url, hash, path)
+		if err == nil || runCtx.Err() != nil {
+			return err
+		}
+
+		log.WithFields(logrus.Fields{
+			"recipe": recipe,
+			"url":    url,
+			"err":    err,
+		}).Warn("Could not download source from URL")
+	}
+
+	if len(urls) > 1 {
+		err = fmt.Errorf("could not download from any of %d URLs, last error: %s", len(urls), err)
+	}
+	return err
+}
+
+// Returns the URLs to download a source from, in the order they should be
+// tried: for the source's URL and then each of its mirrors, the result of
+// each rewrite rule that applies to it, and then the URL itself.
+func sourceURLs(source string, mirrors []string, rewrites []config.URLRewrite) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	add := func(url string) {
+		if !seen[url] {
+			seen[url] = true
+			ret = append(ret, url)
+		}
+	}
 
-	sum := hasher.Sum(nil)
-	ssum := hex.EncodeToString(sum)
+	for _, url := range append([]string{source}, mirrors...) {
+		for _, rule := range rewrites {
+			if rewritten, ok := rule.Rewrite(url); ok {
+				add(rewritten)
+			}
+		}
+		add(url)
+	}
+	return ret
+}
+
+func (c *sourceCache) compareHash(path, hash string) error {
+	ssum, err := fileHash(path)
+	if err != nil {
+		return err
+	}
 
 	if !strings.EqualFold(ssum, hash) {
 		return fmt.Errorf(
@@ -134,6 +327,22 @@ func (c *sourceCache) compareHash(path, hash string) error {
 	return nil
 }
 
+// Returns the hex-encoded SHA-256 hash of the given file.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 // Splits the given source string into a filename to save to, and the source
 // URL to be fetched.
 func SplitSource(in string) (filename, source string) {
@@ -0,0 +1,245 @@
+package builder
+
+import (
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+func TestSourceURLs(t *testing.T) {
+	rewrites := []config.URLRewrite{
+		{From: "https://ftp.gnu.org/gnu/", To: "http://mirror.internal/gnu/"},
+		{From: "https://ftpmirror.gnu.org/", To: "http://mirror.internal/gnu/"},
+	}
+
+	urls := sourceURLs(
+		"https://ftp.gnu.org/gnu/tar/tar-1.28.tar.xz",
+		[]string{
+			"https://ftpmirror.gnu.org/tar/tar-1.28.tar.xz",
+			"https://example.com/tar-1.28.tar.xz",
+		},
+		rewrites,
+	)
+	assert.Equal(t, []string{
+		"http://mirror.internal/gnu/tar/tar-1.28.tar.xz",
+		"https://ftp.gnu.org/gnu/tar/tar-1.28.tar.xz",
+		"https://ftpmirror.gnu.org/tar/tar-1.28.tar.xz",
+		"https://example.com/tar-1.28.tar.xz",
+	}, urls)
+
+	assert.Equal(t, []string{"https://example.com/foo.tar.gz"},
+		sourceURLs("https://example.com/foo.tar.gz", nil, rewrites))
+}
+
+func TestFetchMirrors(t *testing.T) {
+	data, sum := testData()
+
+	var (
+		lock      sync.Mutex
+		requested []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requested = append(requested, r.URL.Path)
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/internal/foo.tar.gz":
+			http.NotFound(w, r)
+		case "/changed/foo.tar.gz":
+			w.Write([]byte("not the right file"))
+		case "/good/foo.tar.gz":
+			w.Write(data)
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	require.NoError(t, os.Mkdir(srcDir, 0755))
+
+	cache, err := newSourceCache(filepath.Join(dir, "cache"), []config.URLRewrite{
+		{From: server.URL + "/changed/", To: server.URL + "/internal/"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(cache.rootDir, 0755))
+	cache.downloader.backoff = time.Millisecond
+
+	err = cache.Fetch(
+		stdcontext.Background(),
+		"foo",
+		server.URL+"/changed/foo.tar.gz",
+		[]string{server.URL + "/good/foo.tar.gz"},
+		sum,
+		srcDir,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"/internal/foo.tar.gz",
+		"/changed/foo.tar.gz",
+		"/good/foo.tar.gz",
+	}, requested)
+
+	got, err := ioutil.ReadFile(filepath.Join(srcDir, "foo.tar.gz"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.True(t, cache.Contains("foo", server.URL+"/changed/foo.tar.gz", sum))
+}
+
+func TestCacheSharedContent(t *testing.T) {
+	data, sum := testData()
+
+	var (
+		lock      sync.Mutex
+		requested []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requested = append(requested, r.URL.Path)
+		lock.Unlock()
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := newSourceCache(dir, nil)
+	require.NoError(t, err)
+
+	// The same file, used by two recipes, and renamed by one of them.
+	sources := []struct{ recipe, source string }{
+		{"foo", server.URL + "/foo-1.0.tar.gz"},
+		{"bar", server.URL + "/foo-1.0.tar.gz"},
+		{"bar", "foo.tar.gz::" + server.URL + "/foo-1.0.tar.gz"},
+	}
+	for i, s := range sources {
+		downloaded, err := cache.Ensure(stdcontext.Background(), s.recipe, s.source, nil, sum)
+		require.NoError(t, err)
+		assert.Equal(t, i == 0, downloaded, "source %d", i)
+	}
+	assert.Equal(t, []string{"/foo-1.0.tar.gz"}, requested)
+
+	assertDownloaded(t, filepath.Join(dir, "sha256", sum), data)
+	for _, path := range []string{"foo/foo-1.0.tar.gz", "bar/foo-1.0.tar.gz", "bar/foo.tar.gz"} {
+		target, err := os.Readlink(filepath.Join(dir, path))
+		require.NoError(t, err, path)
+		assert.Equal(t, filepath.Join("..", "sha256", sum), target, path)
+	}
+
+	// Only the hash is needed to find a source.
+	assert.True(t, cache.Contains("baz", "baz.tar.gz", sum))
+}
+
+func TestCacheMigration(t *testing.T) {
+	data, sum := testData()
+
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A cache from before sources were stored by hash: foo's source is the
+	// right file, and bar's has been replaced by another version.
+	for recipe, contents := range map[string][]byte{"foo": data, "bar": []byte("bar 0.9")} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, recipe), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, recipe, recipe+".tar.gz"), contents, 0644))
+	}
+	oldSum, err := fileHash(filepath.Join(dir, "bar", "bar.tar.gz"))
+	require.NoError(t, err)
+	newSum := sha256.Sum256([]byte("bar 1.0"))
+
+	cache, err := newSourceCache(dir, nil)
+	require.NoError(t, err)
+	cache.offline = true
+
+	// Checking doesn't change the cache.
+	assert.True(t, cache.Contains("foo", "http://127.0.0.1:1/foo.tar.gz", sum))
+	_, err = os.Stat(filepath.Join(dir, "sha256"))
+	assert.True(t, os.IsNotExist(err))
+
+	srcDir := filepath.Join(dir, "src")
+	require.NoError(t, os.Mkdir(srcDir, 0755))
+	require.NoError(t, cache.Fetch(stdcontext.Background(), "foo", "http://127.0.0.1:1/foo.tar.gz", nil, sum, srcDir))
+	assertDownloaded(t, filepath.Join(srcDir, "foo.tar.gz"), data)
+	assertDownloaded(t, filepath.Join(dir, "sha256", sum), data)
+	fi, err := os.Lstat(filepath.Join(dir, "foo", "foo.tar.gz"))
+	require.NoError(t, err)
+	assert.True(t, fi.Mode()&os.ModeSymlink != 0)
+
+	// The other version is kept under its own hash, in case another recipe
+	// needs it, but bar's source has to be downloaded again.
+	_, err = cache.Ensure(stdcontext.Background(), "bar", "http://127.0.0.1:1/bar.tar.gz", nil, hex.EncodeToString(newSum[:]))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "downloads are disabled")
+	assertDownloaded(t, filepath.Join(dir, "sha256", oldSum), []byte("bar 0.9"))
+	assert.True(t, cache.Contains("baz", "bar.tar.gz", oldSum))
+}
+
+func TestCacheMigrationConcurrent(t *testing.T) {
+	data, sum := testData()
+	other := []byte("other")
+	otherSum := sha256.Sum256(other)
+
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := newSourceCache(dir, nil)
+	require.NoError(t, err)
+	cache.offline = true
+
+	// Two recipes whose old cached sources each have the content that the
+	// other one asks for, so that migrating either one needs the lock for
+	// the other's hash.
+	files := map[string][]byte{"foo": other, "bar": data}
+	sums := map[string]string{"foo": sum, "bar": hex.EncodeToString(otherSum[:])}
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, os.RemoveAll(dir))
+		for recipe, contents := range files {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, recipe), 0755))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, recipe, "src.tar.gz"), contents, 0644))
+		}
+
+		// Whether a racing build finds the other recipe's source depends on
+		// which migration finishes first, but none of them may hang.
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			for recipe := range files {
+				wg.Add(1)
+				go func(recipe string) {
+					defer wg.Done()
+					cache.Ensure(stdcontext.Background(), recipe, "http://127.0.0.1:1/src.tar.gz", nil, sums[recipe])
+				}(recipe)
+			}
+		}
+		wg.Wait()
+
+		for recipe := range files {
+			_, err := cache.Ensure(stdcontext.Background(), recipe, "http://127.0.0.1:1/src.tar.gz", nil, sums[recipe])
+			require.NoError(t, err, recipe)
+		}
+		assertDownloaded(t, filepath.Join(dir, "foo", "src.tar.gz"), data)
+		assertDownloaded(t, filepath.Join(dir, "bar", "src.tar.gz"), other)
+	}
+}
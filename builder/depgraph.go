@@ -0,0 +1,143 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Graph is the dependency graph of a set of recipes for a single platform and
+// architecture.
+type Graph struct {
+	Platform string       `json:"platform"`
+	Arch     string       `json:"arch"`
+	Nodes    []*GraphNode `json:"nodes"`
+	Edges    []*GraphEdge `json:"edges"`
+}
+
+// GraphNode is a single recipe in a dependency graph.
+type GraphNode struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Library bool   `json:"library"`
+	Binary  bool   `json:"binary"`
+}
+
+// GraphEdge indicates that one recipe directly depends on another.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DependencyGraph returns the graph of the given recipes and everything they
+// depend on, when built for the given platform and architecture.
+func DependencyGraph(recipes []string, platform, arch string) (*Graph, error) {
+	depgraph, err := recipeGraph(recipes, platform, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Graph{
+		Platform: platform,
+		Arch:     arch,
+	}
+
+	for name, dependents := range depgraph {
+		info := recipesRegistry[name].Info()
+		ret.Nodes = append(ret.Nodes, &GraphNode{
+			Name:    name,
+			Version: info.Version,
+			Library: info.Library,
+			Binary:  info.Binary,
+		})
+
+		for _, dependent := range dependents {
+			ret.Edges = append(ret.Edges, &GraphEdge{
+				From: dependent,
+				To:   name,
+			})
+		}
+	}
+
+	// Sort everything, so that the output is stable.
+	sort.Slice(ret.Nodes, func(i, j int) bool {
+		return ret.Nodes[i].Name < ret.Nodes[j].Name
+	})
+	sort.Slice(ret.Edges, func(i, j int) bool {
+		if ret.Edges[i].From != ret.Edges[j].From {
+			return ret.Edges[i].From < ret.Edges[j].From
+		}
+		return ret.Edges[i].To < ret.Edges[j].To
+	})
+
+	return ret, nil
+}
+
+// Returns a short description of the kind of recipe a node is.
+func (n *GraphNode) kind() string {
+	switch {
+	case n.Library && n.Binary:
+		return "library, binary"
+	case n.Library:
+		return "library"
+	case n.Binary:
+		return "binary"
+	}
+	return ""
+}
+
+// WriteDOT writes the graph in Graphviz DOT format.  Binaries are drawn as
+// boxes, and libraries as ellipses.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	printf("digraph %q {\n", g.Platform+"/"+g.Arch)
+	for _, n := range g.Nodes {
+		shape := "ellipse"
+		if n.Binary {
+			shape = "box"
+		}
+
+		printf("\t%q [label=%q, shape=%s];\n",
+			n.Name, n.Name+"\n"+n.Version+"\n("+n.kind()+")", shape)
+	}
+	for _, e := range g.Edges {
+		printf("\t%q -> %q;\n", e.From, e.To)
+	}
+	printf("}\n")
+
+	return err
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart.  Binaries are drawn as
+// rectangles, and libraries as rounded boxes.
+func (g *Graph) WriteMermaid(w io.Writer) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	printf("graph TD\n")
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%s %s<br/>(%s)", n.Name, n.Version, n.kind())
+		if n.Binary {
+			printf("    %s[\"%s\"]:::binary\n", n.Name, label)
+		} else {
+			printf("    %s([\"%s\"]):::library\n", n.Name, label)
+		}
+	}
+	for _, e := range g.Edges {
+		printf("    %s --> %s\n", e.From, e.To)
+	}
+	printf("    classDef binary stroke-width:2px\n")
+	printf("    classDef library stroke-dasharray:4\n")
+
+	return err
+}
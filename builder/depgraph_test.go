@@ -0,0 +1,133 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A recipe with extra dependencies on some platforms.
+type platformDepsRecipe struct {
+	*testRecipe
+	platformDeps map[string][]string
+}
+
+func (r *platformDepsRecipe) Dependencies(platform, arch string) []string {
+	return append(append([]string(nil), r.deps...), r.platformDeps[platform]...)
+}
+
+func withTestGraphRegistry() func() {
+	library := func(name, version string, deps ...string) *testRecipe {
+		r := newTestRecipe(name, deps...)
+		r.info.Version = version
+		r.info.Library = true
+		return r
+	}
+
+	restore := withTestRegistry(
+		library("zlib", "1.2.8"),
+		library("openssl", "1.0.2", "zlib"),
+		library("libiconv", "1.14"),
+	)
+
+	socat := newTestRecipe("socat", "openssl")
+	socat.info.Version = "1.7.3.0"
+	socat.info.Binary = true
+	RegisterRecipe(&platformDepsRecipe{
+		testRecipe:   socat,
+		platformDeps: map[string][]string{"darwin": {"libiconv"}},
+	})
+
+	return restore
+}
+
+func TestDependencyGraph(t *testing.T) {
+	defer withTestGraphRegistry()()
+
+	g, err := DependencyGraph([]string{"socat"}, "darwin", "amd64")
+	require.NoError(t, err)
+	assert.Equal(t, "darwin", g.Platform)
+	assert.Equal(t, "amd64", g.Arch)
+	assert.Equal(t, []*GraphNode{
+		{Name: "libiconv", Version: "1.14", Library: true},
+		{Name: "openssl", Version: "1.0.2", Library: true},
+		{Name: "socat", Version: "1.7.3.0", Binary: true},
+		{Name: "zlib", Version: "1.2.8", Library: true},
+	}, g.Nodes)
+	assert.Equal(t, []*GraphEdge{
+		{From: "openssl", To: "zlib"},
+		{From: "socat", To: "libiconv"},
+		{From: "socat", To: "openssl"},
+	}, g.Edges)
+
+	// The dependency on libiconv is only there on darwin.
+	g, err = DependencyGraph([]string{"socat"}, "linux", "amd64")
+	require.NoError(t, err)
+	var names []string
+	for _, n := range g.Nodes {
+		names = append(names, n.Name)
+	}
+	assert.Equal(t, []string{"openssl", "socat", "zlib"}, names)
+	assert.Equal(t, []*GraphEdge{
+		{From: "openssl", To: "zlib"},
+		{From: "socat", To: "openssl"},
+	}, g.Edges)
+
+	_, err = DependencyGraph([]string{"nonexistent"}, "linux", "amd64")
+	assert.Error(t, err)
+}
+
+func TestGraphOutput(t *testing.T) {
+	defer withTestGraphRegistry()()
+
+	g, err := DependencyGraph([]string{"socat"}, "darwin", "amd64")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, g.WriteDOT(&buf))
+	assert.Equal(t, `digraph "darwin/amd64" {
+	"libiconv" [label="libiconv\n1.14\n(library)", shape=ellipse];
+	"openssl" [label="openssl\n1.0.2\n(library)", shape=ellipse];
+	"socat" [label="socat\n1.7.3.0\n(binary)", shape=box];
+	"zlib" [label="zlib\n1.2.8\n(library)", shape=ellipse];
+	"openssl" -> "zlib";
+	"socat" -> "libiconv";
+	"socat" -> "openssl";
+}
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, g.WriteMermaid(&buf))
+	assert.Equal(t, `graph TD
+    libiconv(["libiconv 1.14<br/>(library)"]):::library
+    openssl(["openssl 1.0.2<br/>(library)"]):::library
+    socat["socat 1.7.3.0<br/>(binary)"]:::binary
+    zlib(["zlib 1.2.8<br/>(library)"]):::library
+    openssl --> zlib
+    socat --> libiconv
+    socat --> openssl
+    classDef binary stroke-width:2px
+    classDef library stroke-dasharray:4
+`, buf.String())
+
+	data, err := json.Marshal(g)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"platform": "darwin",
+		"arch": "amd64",
+		"nodes": [
+			{"name": "libiconv", "version": "1.14", "library": true, "binary": false},
+			{"name": "openssl", "version": "1.0.2", "library": true, "binary": false},
+			{"name": "socat", "version": "1.7.3.0", "library": false, "binary": true},
+			{"name": "zlib", "version": "1.2.8", "library": true, "binary": false}
+		],
+		"edges": [
+			{"from": "openssl", "to": "zlib"},
+			{"from": "socat", "to": "libiconv"},
+			{"from": "socat", "to": "openssl"}
+		]
+	}`, string(data))
+}
@@ -0,0 +1,344 @@
+package builder
+
+import (
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/andrew-d/sbuild/util"
+)
+
+// Defaults for downloads.
+const (
+	// How many times to try a download, and how long to wait before the
+	// first retry.  The wait is doubled after every failed attempt, up to
+	// the maximum.
+	downloadAttempts   = 5
+	downloadBackoff    = 2 * time.Second
+	downloadMaxBackoff = 30 * time.Second
+
+	// How long connecting to a server and waiting for its response may take,
+	// and how long a download may go without receiving any data.
+	downloadConnectTimeout = 30 * time.Second
+	downloadIdleTimeout    = time.Minute
+
+	// How often to log the progress of a download.
+	downloadProgressInterval = 10 * time.Second
+)
+
+// The suffix of the file that a source is downloaded to, before it has been
+// verified.  If a download is interrupted, the next one resumes from it.
+const partialSuffix = ".part"
+
+// downloader downloads sources over HTTP(S), verifying them as they're
+// downloaded.  Proxies are taken from the environment (e.g. https_proxy).
+type downloader struct {
+	client *http.Client
+
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	idleTimeout      time.Duration
+	progressInterval time.Duration
+}
+
+func newDownloader() *downloader {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   downloadConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   downloadConnectTimeout,
+		ResponseHeaderTimeout: downloadConnectTimeout,
+	}
+
+	return &downloader{
+		client:           &http.Client{Transport: transport},
+		attempts:         downloadAttempts,
+		backoff:          downloadBackoff,
+		maxBackoff:       downloadMaxBackoff,
+		idleTimeout:      downloadIdleTimeout,
+		progressInterval: downloadProgressInterval,
+	}
+}
+
+// An error that retrying the download won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Download downloads the given URL to the given path, which is only created
+// once the download is complete and its SHA-256 matches the given hash.
+// Failed attempts are retried, resuming from where they stopped if the server
+// supports it.  Downloads are stopped if the context is cancelled.
+func (d *downloader) Download(runCtx stdcontext.Context, url, hash, path string) error {
+	part := path + partialSuffix
+	backoff := d.backoff
+
+	var err error
+	for attempt := 1; attempt <= d.attempts; attempt++ {
+		if attempt > 1 {
+			log.WithFields(logrus.Fields{
+				"url":     url,
+				"attempt": attempt,
+				"err":     err,
+			}).Warn("Download failed, retrying")
+
+			select {
+			case <-time.After(backoff):
+			case <-runCtx.Done():
+				return runCtx.Err()
+			}
+			if backoff *= 2; backoff > d.maxBackoff {
+				backoff = d.maxBackoff
+			}
+		}
+
+		var (
+			sum     string
+			resumed bool
+		)
+		sum, resumed, err = d.attempt(runCtx, url, part)
+		if ctxErr := runCtx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if perr, ok := err.(*permanentError); ok {
+			os.Remove(part)
+			return perr.err
+		}
+		if err != nil {
+			continue
+		}
+
+		if !strings.EqualFold(sum, hash) {
+			os.Remove(part)
+			err = fmt.Errorf(
+				"hash of file %s (%s) does not match expected value",
+				filepath.Base(path),
+				sum,
+			)
+
+			// The partial download that we resumed might have been of a
+			// different file, so start over.
+			if resumed {
+				continue
+			}
+			return err
+		}
+
+		return os.Rename(part, path)
+	}
+
+	return err
+}
+
+// Makes a single attempt at downloading the given URL, appending to the
+// partial download if there is one.  Returns the SHA-256 of the whole file,
+// and whether a partial download was resumed.
+func (d *downloader) attempt(runCtx stdcontext.Context, url, part string) (string, bool, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return d.curl(runCtx, url, part)
+	}
+
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", false, &permanentError{err}
+	}
+	defer f.Close()
+
+	// Hash what we already have, which leaves the file positioned at its end.
+	hasher := sha256.New()
+	offset, err := io.Copy(hasher, f)
+	if err != nil {
+		return "", false, &permanentError{err}
+	}
+
+	reqCtx, cancel := stdcontext.WithCancel(runCtx)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", false, &permanentError{err}
+	}
+	req = req.WithContext(reqCtx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(part)
+			return "", false, fmt.Errorf("%s: unexpected Content-Range: %s",
+				url, resp.Header.Get("Content-Range"))
+		}
+
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// We already have the whole file.
+		return hex.EncodeToString(hasher.Sum(nil)), true, nil
+
+	case resp.StatusCode == http.StatusOK:
+		// Either we didn't ask for a range, or the server doesn't support
+		// them, so start from the beginning.
+		if err := restart(f, hasher); err != nil {
+			return "", false, &permanentError{err}
+		}
+		offset = 0
+
+	default:
+		err := fmt.Errorf("%s: %s", url, resp.Status)
+		if resp.StatusCode >= 500 ||
+			resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests {
+			return "", false, err
+		}
+		return "", false, &permanentError{err}
+	}
+
+	// Give up if no data arrives for too long.
+	var stalled int32
+	timer := time.AfterFunc(d.idleTimeout, func() {
+		atomic.StoreInt32(&stalled, 1)
+		cancel()
+	})
+	defer timer.Stop()
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	progress := &downloadProgress{
+		url:      url,
+		done:     offset,
+		total:    total,
+		interval: d.progressInterval,
+		last:     time.Now(),
+	}
+
+	_, err = io.Copy(
+		io.MultiWriter(f, hasher, progress),
+		&idleReader{r: resp.Body, timer: timer, timeout: d.idleTimeout},
+	)
+	if err != nil {
+		if atomic.LoadInt32(&stalled) != 0 {
+			err = fmt.Errorf("%s: no data received for %s", url, d.idleTimeout)
+		}
+		return "", offset > 0, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), offset > 0, nil
+}
+
+// Downloads a URL that net/http doesn't support (e.g. FTP) with curl.
+func (d *downloader) curl(runCtx stdcontext.Context, url, part string) (string, bool, error) {
+	var resumed bool
+	if fi, err := os.Stat(part); err == nil && fi.Size() > 0 {
+		resumed = true
+	}
+
+	cmd := exec.Command(
+		"curl",
+		"-L",
+		"--fail",
+		"-C", "-",
+		"-o", part,
+		url,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := util.RunCommand(runCtx, cmd); err != nil {
+		return "", resumed, err
+	}
+
+	f, err := os.Open(part)
+	if err != nil {
+		return "", resumed, err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", resumed, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), resumed, nil
+}
+
+// Discards everything in a partial download.
+func restart(f *os.File, hasher hash.Hash) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hasher.Reset()
+	return nil
+}
+
+// idleReader resets a timer whenever data is read.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// downloadProgress periodically logs how much of a download has completed.
+type downloadProgress struct {
+	url         string
+	done, total int64
+
+	interval time.Duration
+	last     time.Time
+}
+
+func (p *downloadProgress) Write(data []byte) (int, error) {
+	p.done += int64(len(data))
+	if time.Since(p.last) < p.interval {
+		return len(data), nil
+	}
+	p.last = time.Now()
+
+	fields := logrus.Fields{
+		"url":   p.url,
+		"bytes": p.done,
+	}
+	if p.total > 0 {
+		fields["total"] = p.total
+		fields["percent"] = p.done * 100 / p.total
+	}
+	log.WithFields(fields).Info("Downloading")
+	return len(data), nil
+}
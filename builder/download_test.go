@@ -0,0 +1,241 @@
+package builder
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A source served by a test server, which can misbehave for the first few
+// requests.
+type testSource struct {
+	data []byte
+
+	lock     sync.Mutex
+	requests []*http.Request
+
+	// Called for each request, with the number of requests before it.  If it
+	// returns true, the request has been handled.
+	misbehave func(n int, w http.ResponseWriter, r *http.Request) bool
+}
+
+func (s *testSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	n := len(s.requests)
+	s.requests = append(s.requests, r)
+	s.lock.Unlock()
+
+	if s.misbehave != nil && s.misbehave(n, w, r) {
+		return
+	}
+	http.ServeContent(w, r, "source.tar.gz", time.Time{}, bytes.NewReader(s.data))
+}
+
+// Returns the Range headers of all requests so far.
+func (s *testSource) ranges() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ret []string
+	for _, r := range s.requests {
+		ret = append(ret, r.Header.Get("Range"))
+	}
+	return ret
+}
+
+func setupDownload(t *testing.T, source *testSource) (*downloader, string, string, func()) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+
+	server := httptest.NewServer(source)
+
+	d := newDownloader()
+	d.backoff = time.Millisecond
+	d.maxBackoff = time.Millisecond
+	d.idleTimeout = 100 * time.Millisecond
+
+	return d, server.URL + "/source.tar.gz", filepath.Join(dir, "source.tar.gz"), func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testData() ([]byte, string) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:])
+}
+
+func assertDownloaded(t *testing.T, path string, data []byte) {
+	got, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = os.Stat(path + partialSuffix)
+	assert.True(t, os.IsNotExist(err), "partial download left behind")
+}
+
+func TestDownload(t *testing.T) {
+	data, sum := testData()
+	source := &testSource{data: data}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+
+	require.NoError(t, d.Download(stdcontext.Background(), url, sum, path))
+	assertDownloaded(t, path, data)
+	assert.Equal(t, []string{""}, source.ranges())
+}
+
+func TestDownloadHashMismatch(t *testing.T) {
+	data, _ := testData()
+	source := &testSource{data: data}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+
+	err := d.Download(stdcontext.Background(), url, "0000", path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match expected value")
+
+	// Nothing is left in the cache.
+	for _, p := range []string{path, path + partialSuffix} {
+		_, err = os.Stat(p)
+		assert.True(t, os.IsNotExist(err), "%s exists", p)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	data, sum := testData()
+	source := &testSource{data: data}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+
+	// A previous download was interrupted half-way through.
+	require.NoError(t, ioutil.WriteFile(path+partialSuffix, data[:1000], 0644))
+
+	require.NoError(t, d.Download(stdcontext.Background(), url, sum, path))
+	assertDownloaded(t, path, data)
+	assert.Equal(t, []string{"bytes=1000-"}, source.ranges())
+}
+
+func TestDownloadResumeStale(t *testing.T) {
+	data, sum := testData()
+	source := &testSource{data: data}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+
+	// The partial download is of a different file, so resuming it gives the
+	// wrong hash and the download starts over.
+	require.NoError(t, ioutil.WriteFile(path+partialSuffix, []byte("garbage"), 0644))
+
+	require.NoError(t, d.Download(stdcontext.Background(), url, sum, path))
+	assertDownloaded(t, path, data)
+	assert.Equal(t, []string{"bytes=7-", ""}, source.ranges())
+}
+
+func TestDownloadRetries(t *testing.T) {
+	data, sum := testData()
+	source := &testSource{
+		data: data,
+		misbehave: func(n int, w http.ResponseWriter, r *http.Request) bool {
+			switch n {
+			case 0:
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return true
+
+			case 1:
+				// Send half the file, then drop the connection.
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(data[:len(data)/2])
+				panic(http.ErrAbortHandler)
+			}
+			return false
+		},
+	}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+
+	require.NoError(t, d.Download(stdcontext.Background(), url, sum, path))
+	assertDownloaded(t, path, data)
+
+	ranges := source.ranges()
+	require.Len(t, ranges, 3)
+	assert.Equal(t, "", ranges[1])
+	assert.NotEqual(t, "", ranges[2], "download was not resumed")
+}
+
+func TestDownloadPermanentError(t *testing.T) {
+	source := &testSource{
+		misbehave: func(n int, w http.ResponseWriter, r *http.Request) bool {
+			http.NotFound(w, r)
+			return true
+		},
+	}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+
+	err := d.Download(stdcontext.Background(), url, "0000", path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+	assert.Len(t, source.ranges(), 1)
+}
+
+func TestDownloadIdleTimeout(t *testing.T) {
+	data, sum := testData()
+	source := &testSource{
+		data: data,
+		misbehave: func(n int, w http.ResponseWriter, r *http.Request) bool {
+			if n > 0 {
+				return false
+			}
+
+			// Send a little, then stall.
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:100])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return true
+		},
+	}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+
+	require.NoError(t, d.Download(stdcontext.Background(), url, sum, path))
+	assertDownloaded(t, path, data)
+	assert.Equal(t, []string{"", "bytes=100-"}, source.ranges())
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	source := &testSource{
+		misbehave: func(n int, w http.ResponseWriter, r *http.Request) bool {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return true
+		},
+	}
+	d, url, path, cleanup := setupDownload(t, source)
+	defer cleanup()
+	d.backoff = time.Hour
+
+	runCtx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err := d.Download(runCtx, url, "0000", path)
+	assert.Equal(t, stdcontext.Canceled, err)
+}
@@ -0,0 +1,142 @@
+package builder
+
+import (
+	stdcontext "context"
+	"os"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+// The number of sources that FetchSources downloads at once, unless the
+// configuration allows more jobs.
+const defaultFetchJobs = 4
+
+// Possible values for the status of a FetchedSource.
+const (
+	// Downloaded and verified.
+	FetchDownloaded = "downloaded"
+
+	// Already in the cache, and verified.
+	FetchCached = "cached"
+
+	// Could not be downloaded, or didn't match its hash.
+	FetchFailed = "failed"
+)
+
+// FetchedSource is the result of fetching a single source into the cache.
+type FetchedSource struct {
+	Recipe   string `json:"recipe"`
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// FetchSources downloads every source needed to build the given recipes for
+// each of the given targets into the configuration's source cache, and
+// verifies them, without building anything.  Sources are fetched at the same
+// time, up to the configuration's number of jobs (or defaultFetchJobs, if
+// that's more).
+//
+// Failing to fetch a source doesn't stop the others, and isn't an error:
+// the results for every source are returned, sorted by recipe and filename.
+// Only invalid recipes, or cancelling the context, cause an error.
+func FetchSources(runCtx stdcontext.Context, recipes []string, conf *config.BuildConfig, targets []config.Target) ([]*FetchedSource, error) {
+	// Recipes' sources don't depend on the target, but which recipes are
+	// needed does.
+	needed := make(map[string]bool)
+	for _, target := range targets {
+		order, err := getRecipeDeps(recipes, target.Platform, target.Arch)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range order {
+			needed[name] = true
+		}
+	}
+
+	cacheDir := conf.SourceCacheDir()
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	cache, err := newSourceCache(cacheDir, conf.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+	cache.offline = conf.Offline
+
+	// Every source is a node in a graph without any edges, so that the
+	// scheduler runs them all at once.
+	type fetchJob struct {
+		recipe, source, hash string
+		mirrors              []string
+		result               *FetchedSource
+	}
+	jobs := make(map[string]*fetchJob)
+	g := make(graph)
+	for name := range needed {
+		info := recipesRegistry[name].Info()
+		sources, mirrors := expandSources(info)
+		for i, source := range sources {
+			filename, url := SplitSource(source)
+			id := name + "/" + filename
+			jobs[id] = &fetchJob{
+				recipe:  name,
+				source:  source,
+				hash:    info.Sums[i],
+				mirrors: mirrors[i],
+				result: &FetchedSource{
+					Recipe:   name,
+					Filename: filename,
+					URL:      url,
+				},
+			}
+			g[id] = nil
+		}
+	}
+
+	parallel := conf.Jobs
+	if parallel < defaultFetchJobs {
+		parallel = defaultFetchJobs
+	}
+
+	newScheduler(g, parallel).run(func(id string) error {
+		job := jobs[id]
+		downloaded, err := cache.Ensure(runCtx, job.recipe, job.source, job.mirrors, job.hash)
+		switch {
+		case err != nil:
+			job.result.Status = FetchFailed
+			job.result.Error = err.Error()
+			log.WithFields(logrus.Fields{
+				"recipe": job.recipe,
+				"source": job.result.URL,
+				"err":    err,
+			}).Error("Could not fetch source")
+		case downloaded:
+			job.result.Status = FetchDownloaded
+		default:
+			job.result.Status = FetchCached
+		}
+
+		// Keep going, so that every source is tried, unless we're cancelled.
+		return runCtx.Err()
+	})
+	if err := runCtx.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := make([]*FetchedSource, 0, len(jobs))
+	for _, job := range jobs {
+		ret = append(ret, job.result)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Recipe != ret[j].Recipe {
+			return ret[i].Recipe < ret[j].Recipe
+		}
+		return ret[i].Filename < ret[j].Filename
+	})
+	return ret, nil
+}
@@ -0,0 +1,111 @@
+package builder
+
+import (
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+func TestFetchSources(t *testing.T) {
+	files := map[string][]byte{
+		"/zlib.tar.gz":    []byte("zlib"),
+		"/openssl.tar.gz": []byte("openssl"),
+		"/socat.tar.gz":   []byte("socat"),
+		"/gone.tar.gz":    []byte("pcre"),
+	}
+	sums := make(map[string]string)
+	for path, data := range files {
+		sum := sha256.Sum256(data)
+		sums[path] = hex.EncodeToString(sum[:])
+	}
+
+	// openssl and socat are only served once both have been requested, so
+	// they must be fetched at the same time.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	both := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(both)
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/openssl.tar.gz", "/socat.tar.gz":
+			wg.Done()
+			select {
+			case <-both:
+			case <-time.After(5 * time.Second):
+				http.Error(w, "not fetched concurrently", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		data, ok := files[r.URL.Path]
+		if !ok || r.URL.Path == "/gone.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	recipe := func(name, path, sum string, deps ...string) *testRecipe {
+		r := newTestRecipe(name, deps...)
+		r.info.Sources = []string{server.URL + path}
+		r.info.Sums = []string{sum}
+		return r
+	}
+	defer withTestRegistry(
+		recipe("zlib", "/zlib.tar.gz", sums["/zlib.tar.gz"]),
+		recipe("openssl", "/openssl.tar.gz", sums["/openssl.tar.gz"], "zlib"),
+		recipe("socat", "/socat.tar.gz", sums["/socat.tar.gz"], "openssl"),
+		recipe("pcre", "/gone.tar.gz", sums["/gone.tar.gz"]),
+		recipe("unused", "/unused.tar.gz", "abcd"),
+	)()
+
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &config.BuildConfig{BuildDir: dir}
+	zlibDir := filepath.Join(conf.SourceCacheDir(), "zlib")
+	require.NoError(t, os.MkdirAll(zlibDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(zlibDir, "zlib.tar.gz"), files["/zlib.tar.gz"], 0644))
+
+	results, err := FetchSources(stdcontext.Background(), []string{"socat", "pcre"}, conf, []config.Target{
+		{Platform: "linux", Arch: "amd64"},
+		{Platform: "linux", Arch: "arm"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+
+	// Errors aren't compared, since they depend on the server's address.
+	assert.Equal(t, "pcre", results[1].Recipe)
+	assert.Contains(t, results[1].Error, "404")
+	results[1].Error = ""
+
+	assert.Equal(t, []*FetchedSource{
+		{Recipe: "openssl", Filename: "openssl.tar.gz", URL: server.URL + "/openssl.tar.gz", Status: FetchDownloaded},
+		{Recipe: "pcre", Filename: "gone.tar.gz", URL: server.URL + "/gone.tar.gz", Status: FetchFailed},
+		{Recipe: "socat", Filename: "socat.tar.gz", URL: server.URL + "/socat.tar.gz", Status: FetchDownloaded},
+		{Recipe: "zlib", Filename: "zlib.tar.gz", URL: server.URL + "/zlib.tar.gz", Status: FetchCached},
+	}, results)
+
+	cache, err := newSourceCache(conf.SourceCacheDir(), nil)
+	require.NoError(t, err)
+	assert.True(t, cache.Contains("socat", server.URL+"/socat.tar.gz", sums["/socat.tar.gz"]))
+}
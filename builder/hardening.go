@@ -0,0 +1,250 @@
+package builder
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"strings"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+// Values of the fields of HardeningCheck that can't always be determined.
+const (
+	CheckYes     = "yes"
+	CheckPartial = "partial"
+	CheckNo      = "no"
+	CheckUnknown = "unknown"
+)
+
+// HardeningCheck describes which protections took effect in a single
+// executable, in the style of checksec.
+type HardeningCheck struct {
+	// Whether the code was compiled with a stack protector: "yes" if every
+	// compilation unit whose flags were recorded (see hardenStaticFlags)
+	// was, "partial" if only some were, and "unknown" if no flags were
+	// recorded.  Symbols can't be used for this, since static binaries contain
+	// __stack_chk_fail whenever libc does.
+	Canary string `json:"canary"`
+
+	// Whether checked versions of libc functions (e.g. __memcpy_chk) are
+	// used, which is only known if the binary has a symbol table.
+	Fortify string `json:"fortify"`
+
+	// "full" if there's a read-only-after-relocation segment and nothing is
+	// resolved lazily, "partial" if relocations may be resolved lazily, or
+	// "none".
+	RELRO string `json:"relro"`
+
+	// Whether the executable is position-independent.
+	PIE bool `json:"pie"`
+
+	// Whether the stack is non-executable.
+	NX bool `json:"nx"`
+}
+
+// String returns a one-line summary of the check.
+func (c *HardeningCheck) String() string {
+	return fmt.Sprintf("canary=%s fortify=%s relro=%s pie=%t nx=%t",
+		c.Canary, c.Fortify, c.RELRO, c.PIE, c.NX)
+}
+
+// Checks that the given hardening level is known.
+func checkHardening(level string) error {
+	switch level {
+	case config.HardeningNone, config.HardeningBasic, config.HardeningPIE:
+		return nil
+	}
+	return fmt.Errorf("builder: unknown hardening level: %s", level)
+}
+
+// Returns the static flags to use for the given hardening level and platform,
+// given the flags without hardening.
+func hardenStaticFlags(level, platform, staticFlags string) string {
+	if level == config.HardeningNone {
+		return staticFlags
+	}
+
+	// _FORTIFY_SOURCE only works when optimizing.  The compiler records its
+	// flags in the binary, so we can check that they were actually used.
+	flags := " -fstack-protector-strong -O2 -D_FORTIFY_SOURCE=2 -frecord-gcc-switches "
+
+	// Apple's linker doesn't support RELRO, and its executables are always
+	// position-independent.
+	if platform == "darwin" {
+		return staticFlags + flags
+	}
+
+	flags += " -Wl,-z,relro -Wl,-z,now -Wl,-z,noexecstack "
+	if level == config.HardeningPIE {
+		staticFlags = strings.Replace(staticFlags, " -static ", " -static-pie -fPIE ", 1)
+	}
+	return staticFlags + flags
+}
+
+// Checks which protections took effect in the given executable.
+func checkHardeningELF(f *elf.File) *HardeningCheck {
+	ret := &HardeningCheck{
+		Canary:  CheckUnknown,
+		Fortify: CheckUnknown,
+		RELRO:   "none",
+		PIE:     f.Type == elf.ET_DYN,
+	}
+
+	var relro, dynamic, stack bool
+	for _, prog := range f.Progs {
+		switch prog.Type {
+		case elf.PT_GNU_RELRO:
+			relro = true
+		case elf.PT_DYNAMIC:
+			dynamic = true
+		case elf.PT_GNU_STACK:
+			stack = true
+			ret.NX = prog.Flags&elf.PF_X == 0
+		}
+	}
+
+	// Without a PT_GNU_STACK segment, the stack is usually executable.
+	if !stack {
+		ret.NX = false
+	}
+
+	if relro {
+		ret.RELRO = "partial"
+		if !dynamic || bindNow(f) {
+			ret.RELRO = "full"
+		}
+	}
+
+	if lines := recordedFlags(f); len(lines) > 0 {
+		protected := 0
+		for _, line := range lines {
+			if stackProtected(line) {
+				protected++
+			}
+		}
+		switch protected {
+		case len(lines):
+			ret.Canary = CheckYes
+		case 0:
+			ret.Canary = CheckNo
+		default:
+			ret.Canary = CheckPartial
+		}
+	}
+
+	// The checked versions of libc functions are only linked in if they're
+	// used, but can only be found if the binary isn't stripped.
+	if syms, err := f.Symbols(); err == nil && len(syms) > 0 {
+		ret.Fortify = CheckNo
+		for _, sym := range syms {
+			if strings.HasPrefix(sym.Name, "__") && strings.HasSuffix(sym.Name, "_chk") &&
+				!strings.HasPrefix(sym.Name, "__stack_chk") {
+				ret.Fortify = CheckYes
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+// Returns the compiler command lines recorded in the given file by
+// -frecord-gcc-switches, one for each distinct set of flags.
+func recordedFlags(f *elf.File) []string {
+	section := f.Section(".GCC.command.line")
+	if section == nil {
+		return nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil
+	}
+
+	var ret []string
+	for _, line := range bytes.Split(data, []byte{0}) {
+		if len(line) > 0 {
+			ret = append(ret, string(line))
+		}
+	}
+	return ret
+}
+
+// Returns whether the given compiler command line enables a stack protector.
+// The last flag wins.
+func stackProtected(line string) bool {
+	ret := false
+	for _, flag := range strings.Fields(line) {
+		switch flag {
+		case "-fstack-protector", "-fstack-protector-strong", "-fstack-protector-all":
+			ret = true
+		case "-fno-stack-protector":
+			ret = false
+		}
+	}
+	return ret
+}
+
+// Returns whether the dynamic section of the given file asks for all symbols
+// to be resolved at startup.
+func bindNow(f *elf.File) bool {
+	if flags, err := dynValues(f, elf.DT_FLAGS); err == nil {
+		for _, v := range flags {
+			if elf.DynFlag(v)&elf.DF_BIND_NOW != 0 {
+				return true
+			}
+		}
+	}
+	if flags, err := dynValues(f, elf.DT_FLAGS_1); err == nil {
+		for _, v := range flags {
+			if elf.DynFlag1(v)&elf.DF_1_NOW != 0 {
+				return true
+			}
+		}
+	}
+	if now, err := dynValues(f, elf.DT_BIND_NOW); err == nil && len(now) > 0 {
+		return true
+	}
+	return false
+}
+
+// Returns the values of all entries in the dynamic section with the given tag.
+func dynValues(f *elf.File, tag elf.DynTag) ([]uint64, error) {
+	ds := f.SectionByType(elf.SHT_DYNAMIC)
+	if ds == nil {
+		return nil, nil
+	}
+	data, err := ds.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []uint64
+	for len(data) > 0 {
+		var t elf.DynTag
+		var v uint64
+		switch f.Class {
+		case elf.ELFCLASS32:
+			if len(data) < 8 {
+				return ret, nil
+			}
+			t = elf.DynTag(f.ByteOrder.Uint32(data[0:4]))
+			v = uint64(f.ByteOrder.Uint32(data[4:8]))
+			data = data[8:]
+		case elf.ELFCLASS64:
+			if len(data) < 16 {
+				return ret, nil
+			}
+			t = elf.DynTag(f.ByteOrder.Uint64(data[0:8]))
+			v = f.ByteOrder.Uint64(data[8:16])
+			data = data[16:]
+		default:
+			return ret, nil
+		}
+
+		if t == tag {
+			ret = append(ret, v)
+		}
+	}
+	return ret, nil
+}
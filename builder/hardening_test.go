@@ -0,0 +1,53 @@
+package builder
+
+import (
+	"debug/elf"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+func TestHardenStaticFlags(t *testing.T) {
+	assert.Equal(t, " -static ", hardenStaticFlags(config.HardeningNone, "linux", " -static "))
+
+	basic := hardenStaticFlags(config.HardeningBasic, "linux", " -static ")
+	assert.Contains(t, basic, " -static ")
+	assert.Contains(t, basic, "-fstack-protector-strong")
+	assert.Contains(t, basic, "-D_FORTIFY_SOURCE=2")
+	assert.Contains(t, basic, "-Wl,-z,now")
+
+	pie := hardenStaticFlags(config.HardeningPIE, "linux", " -static ")
+	assert.Contains(t, pie, " -static-pie -fPIE ")
+	assert.NotContains(t, pie, " -static ")
+
+	darwin := hardenStaticFlags(config.HardeningPIE, "darwin", " -flto ")
+	assert.Contains(t, darwin, "-fstack-protector-strong")
+	assert.NotContains(t, darwin, "-Wl,-z")
+
+	assert.NoError(t, checkHardening(config.HardeningPIE))
+	assert.Error(t, checkHardening("extreme"))
+}
+
+func TestStackProtected(t *testing.T) {
+	assert.True(t, stackProtected("GNU C17 12.2.0 -O2 -fstack-protector-strong"))
+	assert.False(t, stackProtected("GNU C17 12.2.0 -O2"))
+	assert.False(t, stackProtected("GNU C17 12.2.0 -fstack-protector -fno-stack-protector"))
+}
+
+func TestCheckHardeningELF(t *testing.T) {
+	// Distributions build their shell with most protections enabled.
+	f, err := elf.Open("/bin/sh")
+	if err != nil {
+		t.Skip("no ELF shell on this host")
+	}
+	defer f.Close()
+
+	check := checkHardeningELF(f)
+	if !check.PIE {
+		t.Skip("host shell is not hardened")
+	}
+	assert.True(t, check.NX)
+	assert.Contains(t, []string{"partial", "full"}, check.RELRO)
+}
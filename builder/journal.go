@@ -0,0 +1,180 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A single step in building a recipe.
+type phase string
+
+const (
+	phaseFetch    phase = "fetch"
+	phaseUnpack   phase = "unpack"
+	phasePrepare  phase = "prepare"
+	phaseBuild    phase = "build"
+	phaseFinalize phase = "finalize"
+
+	// Checks the outputs of the finalize phase.  It isn't recorded in the
+	// journal, since it runs whenever finalize does.
+	phaseVerify phase = "verify"
+
+	// Runs the recipe's tests against its outputs, after verify.  Like
+	// verify, it isn't recorded in the journal.
+	phaseTest phase = "test"
+)
+
+// journalEntry records the progress of the most recent build of a recipe.
+type journalEntry struct {
+	// Key of the build that these phases belong to.
+	Key string `json:"key"`
+
+	// Phases that completed successfully, in order.
+	Phases []phase `json:"phases"`
+
+	// Environment variables that the recipe exported to its dependents.  Only
+	// set once the finalize phase has completed.
+	Env map[string]string `json:"env,omitempty"`
+
+	// The SOURCE_DATE_EPOCH of a reproducible build, which is recorded once
+	// the sources are unpacked, since they can be changed by later phases.
+	SourceDateEpoch int64 `json:"source_date_epoch,omitempty"`
+}
+
+// Returns whether the given phase has completed.
+func (e *journalEntry) Completed(p phase) bool {
+	for _, done := range e.Phases {
+		if done == p {
+			return true
+		}
+	}
+	return false
+}
+
+// journal is a persistent record of the progress of every recipe built in a
+// build directory.  It is saved after every change, so that an interrupted or
+// failed build can be resumed.
+type journal struct {
+	path    string
+	lock    sync.Mutex
+	recipes map[string]*journalEntry
+}
+
+// Opens the journal at the given path, creating an empty one if it doesn't
+// exist.
+func openJournal(path string) (*journal, error) {
+	ret := &journal{
+		path:    path,
+		recipes: make(map[string]*journalEntry),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &ret.recipes); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Entry returns a copy of the journal entry for the given recipe, or nil if
+// the recipe has never been built.
+func (j *journal) Entry(name string) *journalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entry, ok := j.recipes[name]
+	if !ok {
+		return nil
+	}
+
+	ret := *entry
+	ret.Phases = append([]phase(nil), entry.Phases...)
+	return &ret
+}
+
+// Start records that a new build of the given recipe is starting, discarding
+// any progress recorded for a previous build.
+func (j *journal) Start(name, key string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.recipes[name] = &journalEntry{Key: key}
+	return j.save()
+}
+
+// Complete records that the given phase of a recipe's build has finished.
+func (j *journal) Complete(name string, p phase) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entry := j.recipes[name]
+	if !entry.Completed(p) {
+		entry.Phases = append(entry.Phases, p)
+	}
+	return j.save()
+}
+
+// SetSourceDateEpoch records the SOURCE_DATE_EPOCH of a recipe's build.
+func (j *journal) SetSourceDateEpoch(name string, epoch int64) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.recipes[name].SourceDateEpoch = epoch
+	return j.save()
+}
+
+// Finish records that a recipe's build has finished, along with the
+// environment variables it exported.
+func (j *journal) Finish(name, key string, env map[string]string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.recipes[name] = &journalEntry{
+		Key: key,
+		Phases: []phase{
+			phaseFetch,
+			phaseUnpack,
+			phasePrepare,
+			phaseBuild,
+			phaseFinalize,
+		},
+		Env: env,
+	}
+	return j.save()
+}
+
+// Writes the journal to disk.  Must be called with the lock held.
+func (j *journal) save() error {
+	data, err := json.MarshalIndent(j.recipes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it into place, so that a crash
+	// never leaves a truncated journal behind.
+	f, err := ioutil.TempFile(filepath.Dir(j.path), ".journal-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), j.path)
+}
@@ -0,0 +1,75 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal.json")
+	j, err := openJournal(path)
+	require.NoError(t, err)
+	assert.Nil(t, j.Entry("zlib"))
+
+	require.NoError(t, j.Start("zlib", "key1"))
+	require.NoError(t, j.Complete("zlib", phaseFetch))
+	require.NoError(t, j.Complete("zlib", phaseUnpack))
+	require.NoError(t, j.SetSourceDateEpoch("zlib", 1234))
+	require.NoError(t, j.Finish("file", "key2", map[string]string{"LDFLAGS": "-lmagic"}))
+
+	j, err = openJournal(path)
+	require.NoError(t, err)
+
+	entry := j.Entry("zlib")
+	require.NotNil(t, entry)
+	assert.Equal(t, "key1", entry.Key)
+	assert.True(t, entry.Completed(phaseUnpack))
+	assert.False(t, entry.Completed(phasePrepare))
+	assert.Equal(t, int64(1234), entry.SourceDateEpoch)
+
+	entry = j.Entry("file")
+	require.NotNil(t, entry)
+	assert.True(t, entry.Completed(phaseFinalize))
+	assert.Equal(t, "-lmagic", entry.Env["LDFLAGS"])
+
+	// Starting a new build discards old progress.
+	require.NoError(t, j.Start("zlib", "key3"))
+	assert.Empty(t, j.Entry("zlib").Phases)
+}
+
+func TestSelectRecipes(t *testing.T) {
+	g := graph{
+		"zlib":    {"file", "ag"},
+		"pcre":    {"ag"},
+		"file":    nil,
+		"ag":      nil,
+		"openssl": nil,
+	}
+
+	selected, err := selectRecipes(g, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, selected)
+
+	selected, err = selectRecipes(g, []string{"zlib"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"zlib": true, "file": true, "ag": true}, selected)
+
+	selected, err = selectRecipes(g, nil, []string{"zlib"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"zlib": true}, selected)
+
+	_, err = selectRecipes(g, []string{"zlib"}, []string{"ag"})
+	assert.Error(t, err)
+
+	_, err = selectRecipes(g, nil, []string{"socat"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+// MissingSourcesError is returned by an offline build when sources that it
+// needs aren't in the cache.
+type MissingSourcesError struct {
+	// The missing sources, as "recipe: filename (url)".
+	Missing []string
+}
+
+func (e *MissingSourcesError) Error() string {
+	return fmt.Sprintf("%d source(s) needed by the build are not in the cache:\n  %s",
+		len(e.Missing), strings.Join(e.Missing, "\n  "))
+}
+
+// Checks that every source needed to build the given recipes is in the
+// cache, with the right hash.  Recipes that don't need their sources, because
+// a finished build of them can be reused, are skipped.  The set of recipes
+// being rebuilt is as returned by selectRecipes.
+func checkSourcesCached(recipes []string, config *config.BuildConfig, rebuild map[string]bool) error {
+	plan, err := MakePlan(recipes, config)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, r := range plan.Recipes {
+		if rebuild != nil && !rebuild[r.Name] {
+			continue
+		}
+		if rebuild == nil && r.UpToDate {
+			continue
+		}
+
+		for _, s := range r.Sources {
+			if !s.Cached {
+				missing = append(missing, fmt.Sprintf("%s: %s (%s)", r.Name, s.Filename, s.URL))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return &MissingSourcesError{Missing: missing}
+	}
+	return nil
+}
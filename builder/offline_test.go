@@ -0,0 +1,93 @@
+package builder
+
+import (
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+func TestOfflineMissingSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("cached source")
+	sum := sha256.Sum256(data)
+	cachedSum := hex.EncodeToString(sum[:])
+
+	recipe := func(name string, sums []string, deps ...string) *testRecipe {
+		r := newTestRecipe(name, deps...)
+		for i, s := range sums {
+			r.info.Sources = append(r.info.Sources,
+				fmt.Sprintf("http://127.0.0.1:1/%s-%c.tar.gz", name, 'a'+i))
+			r.info.Sums = append(r.info.Sums, s)
+		}
+		return r
+	}
+	defer withTestRegistry(
+		recipe("zlib", []string{cachedSum}),
+		recipe("openssl", []string{cachedSum, cachedSum}, "zlib"),
+		recipe("socat", []string{cachedSum}, "openssl"),
+	)()
+
+	conf := &config.BuildConfig{
+		BuildDir:  filepath.Join(dir, "build"),
+		OutputDir: filepath.Join(dir, "out"),
+		Platform:  "linux",
+		Arch:      "amd64",
+		Offline:   true,
+	}
+
+	// zlib's source is cached, one of openssl's is corrupt, and the other
+	// is missing, as is socat's.
+	cache := conf.SourceCacheDir()
+	for _, path := range []string{"zlib/zlib-a.tar.gz", "openssl/openssl-a.tar.gz"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(cache, filepath.Dir(path)), 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cache, "zlib", "zlib-a.tar.gz"), data, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cache, "openssl", "openssl-a.tar.gz"), []byte("corrupt"), 0644))
+
+	err = Build(stdcontext.Background(), []string{"socat"}, conf)
+	require.IsType(t, &MissingSourcesError{}, err)
+	assert.Equal(t, []string{
+		"openssl: openssl-a.tar.gz (http://127.0.0.1:1/openssl-a.tar.gz)",
+		"openssl: openssl-b.tar.gz (http://127.0.0.1:1/openssl-b.tar.gz)",
+		"socat: socat-a.tar.gz (http://127.0.0.1:1/socat-a.tar.gz)",
+	}, err.(*MissingSourcesError).Missing)
+
+	// Only rebuilding socat doesn't need openssl's sources.
+	conf.Only = []string{"socat"}
+	err = Build(stdcontext.Background(), []string{"socat"}, conf)
+	require.IsType(t, &MissingSourcesError{}, err)
+	assert.Equal(t, []string{
+		"socat: socat-a.tar.gz (http://127.0.0.1:1/socat-a.tar.gz)",
+	}, err.(*MissingSourcesError).Missing)
+}
+
+func TestFetchOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := newSourceCache(dir, nil)
+	require.NoError(t, err)
+	cache.offline = true
+
+	// Nothing listens on this port, but that's not why this fails.
+	err = cache.Fetch(stdcontext.Background(), "foo", "http://127.0.0.1:1/foo.tar.gz", nil, "abcd", dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "downloads are disabled")
+
+	_, err = os.Stat(filepath.Join(dir, "sha256", "abcd"+partialSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
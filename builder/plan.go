@@ -0,0 +1,247 @@
+package builder
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+// Plan describes the build that would be run for a set of recipes, without
+// building anything.  The only commands run to make a plan are the compilers'
+// "--version", which identifies them in the build keys.
+type Plan struct {
+	Platform string `json:"platform"`
+	Arch     string `json:"arch"`
+
+	// Recipes in the order they would be built.
+	Recipes []*PlannedRecipe `json:"recipes"`
+}
+
+// PlannedRecipe describes how a single recipe would be built.
+type PlannedRecipe struct {
+	Name         string           `json:"name"`
+	Version      string           `json:"version"`
+	Dependencies []string         `json:"dependencies"`
+	Sources      []*PlannedSource `json:"sources"`
+	CrossPrefix  string           `json:"cross_prefix"`
+	StaticFlags  string           `json:"static_flags"`
+
+	// The build key, or the empty string if it could not be determined (for
+	// example, because the toolchain is not installed).
+	Key string `json:"key,omitempty"`
+
+	// Whether a finished build with the same key exists, in which case the
+	// recipe would not be rebuilt.
+	UpToDate bool `json:"up_to_date"`
+
+	// Dependencies that would have to be built before the environment
+	// variables they export are known.  These variables are missing from Env.
+	UnknownEnv []string `json:"unknown_env,omitempty"`
+
+	// The environment that would be passed to Prepare and Build, as sorted
+	// "key=value" pairs.
+	Env []string `json:"env"`
+}
+
+// PlannedSource describes a single source of a recipe.
+type PlannedSource struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+	Sum      string `json:"sum"`
+
+	// Every URL that the source would be downloaded from, in the order
+	// they're tried: rewritten URLs first, then the original ones, for the
+	// source's URL and then each of its mirrors.
+	URLs []string `json:"urls"`
+
+	// Whether the source is already in the cache with the right hash.
+	Cached bool `json:"cached"`
+}
+
+// MakePlan resolves the build for the given recipes and configuration, without
+// building, downloading or creating anything.  It does run each compiler with
+// "--version" to compute the build keys, so that they match those of a real
+// build.
+func MakePlan(recipes []string, config *config.BuildConfig) (*Plan, error) {
+	if err := checkHardening(config.Hardening); err != nil {
+		return nil, err
+	}
+
+	order, err := getRecipeDeps(recipes, config.Platform, config.Arch)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newSourceCache(config.SourceCacheDir(), config.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := openJournal(filepath.Join(config.BuildDir, "journal.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &context{
+		runCtx:     stdcontext.Background(),
+		rootEnv:    baseEnv(config),
+		config:     config,
+		cache:      cache,
+		builds:     &buildCache{rootDir: filepath.Join(config.BuildDir, ".builds")},
+		journal:    journal,
+		packageEnv: make(map[string]map[string]string),
+		buildKeys:  make(map[string]string),
+		toolchains: make(map[string]string),
+	}
+
+	plan := &Plan{
+		Platform: config.Platform,
+		Arch:     config.Arch,
+	}
+
+	// Recipes whose exported environment variables we don't know.
+	unknown := make(map[string]bool)
+
+	for _, name := range order {
+		setup := ctx.setupBuild(name)
+
+		planned := &PlannedRecipe{
+			Name:         name,
+			Version:      setup.Info.Version,
+			Dependencies: setup.Recipe.Dependencies(config.Platform, config.Arch),
+			CrossPrefix:  setup.CrossPrefix,
+			StaticFlags:  strings.TrimSpace(setup.StaticFlags),
+			Env:          setup.Env.AsSlice(),
+		}
+		sort.Strings(planned.Env)
+
+		for i, source := range setup.Sources {
+			filename, url := SplitSource(source)
+			planned.Sources = append(planned.Sources, &PlannedSource{
+				Filename: filename,
+				URL:      url,
+				Sum:      setup.Info.Sums[i],
+				URLs:     sourceURLs(url, setup.Mirrors[i], config.Rewrites),
+				Cached:   cache.Contains(name, source, setup.Info.Sums[i]),
+			})
+		}
+
+		seen := make(map[string]bool)
+		for _, dep := range dependencyNames(name, config.Platform, config.Arch) {
+			if unknown[dep] && !seen[dep] {
+				planned.UnknownEnv = append(planned.UnknownEnv, dep)
+			}
+			seen[dep] = true
+		}
+		sort.Strings(planned.UnknownEnv)
+
+		// We can only compute a key if we know the keys of all dependencies.
+		haveDepKeys := true
+		for _, key := range setup.depKeys {
+			if key == "" {
+				haveDepKeys = false
+			}
+		}
+		if haveDepKeys {
+			planned.Key, err = ctx.buildKey(setup)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"recipe": name,
+					"err":    err,
+				}).Warn("Could not identify toolchain")
+			}
+		}
+
+		// If this build has already finished, we know what it exports.
+		var exported map[string]string
+		known := false
+		if planned.Key != "" {
+			if rec, _ := ctx.builds.Lookup(planned.Key); rec != nil {
+				planned.UpToDate = true
+				exported, known = rec.Env, true
+			} else if entry := journal.Entry(name); entry != nil &&
+				entry.Key == planned.Key &&
+				entry.Completed(phaseFinalize) {
+				exported, known = entry.Env, true
+			}
+		}
+		if !known {
+			unknown[name] = true
+		}
+
+		ctx.finishBuild(name, planned.Key, exported)
+		plan.Recipes = append(plan.Recipes, planned)
+	}
+
+	return plan, nil
+}
+
+// WriteText writes a human-readable description of the plan.
+func (p *Plan) WriteText(w io.Writer) error {
+	names := make([]string, len(p.Recipes))
+	for i, r := range p.Recipes {
+		names[i] = r.Name
+	}
+
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	printf("Target:       %s/%s\n", p.Platform, p.Arch)
+	printf("Build order:  %s\n", strings.Join(names, ", "))
+
+	for _, r := range p.Recipes {
+		status := "will build"
+		if r.UpToDate {
+			status = "up to date"
+		}
+
+		deps := "(none)"
+		if len(r.Dependencies) > 0 {
+			deps = strings.Join(r.Dependencies, ", ")
+		}
+
+		key := r.Key
+		if key == "" {
+			key = "(unknown)"
+		}
+
+		printf("\n%s %s (%s)\n", r.Name, r.Version, status)
+		printf("  Key:          %s\n", key)
+		printf("  Dependencies: %s\n", deps)
+		printf("  Cross prefix: %s\n", r.CrossPrefix)
+		printf("  Static flags: %s\n", r.StaticFlags)
+		printf("  Sources:\n")
+		for _, s := range r.Sources {
+			cached := "not cached"
+			if s.Cached {
+				cached = "cached"
+			}
+			printf("    %s\n", s.URL)
+			printf("      file: %s, sha256: %s (%s)\n", s.Filename, s.Sum, cached)
+			if len(s.URLs) > 1 {
+				printf("      tries: %s\n", strings.Join(s.URLs, ", "))
+			}
+		}
+		if len(r.UnknownEnv) > 0 {
+			printf("  Environment from these dependencies is not known until they are built: %s\n",
+				strings.Join(r.UnknownEnv, ", "))
+		}
+		printf("  Environment:\n")
+		for _, v := range r.Env {
+			printf("    %s\n", v)
+		}
+	}
+
+	return err
+}
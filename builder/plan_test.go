@@ -0,0 +1,202 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+// Puts a fake compiler for linux/amd64 first in $PATH, and returns a function
+// that restores the old $PATH.
+func withFakeCompiler(t *testing.T, dir string) func() {
+	binDir := filepath.Join(dir, "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(binDir, "x86_64-linux-musl-gcc"),
+		[]byte("#!/bin/sh\necho 'fake-gcc 1.0'\n"), 0755))
+
+	old := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+old)
+	return func() {
+		os.Setenv("PATH", old)
+	}
+}
+
+func TestMakePlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer withFakeCompiler(t, dir)()
+
+	data := []byte("cached source")
+	sum := sha256.Sum256(data)
+	cachedSum := hex.EncodeToString(sum[:])
+
+	zlib := newTestRecipe("zlib")
+	zlib.info.Version = "1.2.8"
+	zlib.info.Library = true
+	zlib.info.Sources = []string{"http://example.com/${name}-${version}.tar.gz"}
+	zlib.info.Sums = []string{cachedSum}
+	zlib.info.Mirrors = [][]string{{"http://mirror.example.com/${name}-${version}.tar.gz"}}
+
+	socat := newTestRecipe("socat", "zlib")
+	socat.info.Version = "1.7.3.0"
+	socat.info.Sources = []string{"download.tar.gz::http://example.com/socat-${version}.tgz"}
+	socat.info.Sums = []string{"abcd"}
+
+	defer withTestRegistry(zlib, socat)()
+
+	conf := &config.BuildConfig{
+		BuildDir:  filepath.Join(dir, "build"),
+		OutputDir: filepath.Join(dir, "out"),
+		Platform:  "linux",
+		Arch:      "amd64",
+		Hermetic:  true,
+		Rewrites: []config.URLRewrite{
+			{From: "http://example.com/", To: "http://local.example.com/"},
+		},
+	}
+
+	// Only zlib's source is in the cache.
+	cacheDir := filepath.Join(conf.SourceCacheDir(), "zlib")
+	require.NoError(t, os.MkdirAll(cacheDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, "zlib-1.2.8.tar.gz"), data, 0644))
+
+	plan, err := MakePlan([]string{"socat"}, conf)
+	require.NoError(t, err)
+	assert.Equal(t, "linux", plan.Platform)
+	assert.Equal(t, "amd64", plan.Arch)
+	require.Len(t, plan.Recipes, 2)
+
+	z, s := plan.Recipes[0], plan.Recipes[1]
+	assert.Equal(t, "zlib", z.Name)
+	assert.Equal(t, "socat", s.Name)
+	assert.Equal(t, "1.2.8", z.Version)
+	assert.Empty(t, z.Dependencies)
+	assert.Equal(t, []string{"zlib"}, s.Dependencies)
+	assert.Equal(t, "x86_64-linux-musl", z.CrossPrefix)
+	assert.Equal(t, "-static", z.StaticFlags)
+
+	assert.Equal(t, []*PlannedSource{{
+		Filename: "zlib-1.2.8.tar.gz",
+		URL:      "http://example.com/zlib-1.2.8.tar.gz",
+		Sum:      cachedSum,
+		URLs: []string{
+			"http://local.example.com/zlib-1.2.8.tar.gz",
+			"http://example.com/zlib-1.2.8.tar.gz",
+			"http://mirror.example.com/zlib-1.2.8.tar.gz",
+		},
+		Cached: true,
+	}}, z.Sources)
+	assert.Equal(t, []*PlannedSource{{
+		Filename: "download.tar.gz",
+		URL:      "http://example.com/socat-1.7.3.0.tgz",
+		Sum:      "abcd",
+		URLs: []string{
+			"http://local.example.com/socat-1.7.3.0.tgz",
+			"http://example.com/socat-1.7.3.0.tgz",
+		},
+		Cached: false,
+	}}, s.Sources)
+
+	// Nothing has been built, so what zlib exports isn't known yet.
+	assert.NotEmpty(t, z.Key)
+	assert.NotEmpty(t, s.Key)
+	assert.False(t, z.UpToDate)
+	assert.False(t, s.UpToDate)
+	assert.Empty(t, z.UnknownEnv)
+	assert.Equal(t, []string{"zlib"}, s.UnknownEnv)
+
+	// Once a build of zlib is stored, it's up to date with the same key, and
+	// its exported environment is passed on to socat.
+	builds, err := newBuildCache(filepath.Join(conf.BuildDir, ".builds"))
+	require.NoError(t, err)
+	outDir := filepath.Join(dir, "zlib-out")
+	require.NoError(t, os.MkdirAll(outDir, 0755))
+	require.NoError(t, builds.Store(&buildRecord{
+		Name:    "zlib",
+		Version: "1.2.8",
+		Key:     z.Key,
+		Env:     map[string]string{"LDFLAGS": "-lz"},
+	}, outDir, outDir))
+
+	plan2, err := MakePlan([]string{"socat"}, conf)
+	require.NoError(t, err)
+	require.Len(t, plan2.Recipes, 2)
+	assert.Equal(t, z.Key, plan2.Recipes[0].Key)
+	assert.True(t, plan2.Recipes[0].UpToDate)
+	assert.Equal(t, s.Key, plan2.Recipes[1].Key)
+	assert.False(t, plan2.Recipes[1].UpToDate)
+	assert.Empty(t, plan2.Recipes[1].UnknownEnv)
+	assert.Contains(t, plan2.Recipes[1].Env,
+		"LDFLAGS= -L"+filepath.Join(conf.BuildDir, "sysroot", "socat", "usr", "lib")+"  -lz ")
+}
+
+func TestPlanJSON(t *testing.T) {
+	plan := &Plan{
+		Platform: "linux",
+		Arch:     "amd64",
+		Recipes: []*PlannedRecipe{{
+			Name:         "socat",
+			Version:      "1.7.3.0",
+			Dependencies: []string{"zlib"},
+			Sources: []*PlannedSource{{
+				Filename: "socat.tgz",
+				URL:      "http://example.com/socat.tgz",
+				Sum:      "abcd",
+				URLs:     []string{"http://example.com/socat.tgz"},
+				Cached:   true,
+			}},
+			CrossPrefix: "x86_64-linux-musl",
+			StaticFlags: "-static",
+			Key:         "1234",
+			UpToDate:    true,
+			UnknownEnv:  []string{"zlib"},
+			Env:         []string{"CC=x86_64-linux-musl-gcc"},
+		}},
+	}
+
+	data, err := json.Marshal(plan)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"platform": "linux",
+		"arch": "amd64",
+		"recipes": [{
+			"name": "socat",
+			"version": "1.7.3.0",
+			"dependencies": ["zlib"],
+			"sources": [{
+				"filename": "socat.tgz",
+				"url": "http://example.com/socat.tgz",
+				"sum": "abcd",
+				"urls": ["http://example.com/socat.tgz"],
+				"cached": true
+			}],
+			"cross_prefix": "x86_64-linux-musl",
+			"static_flags": "-static",
+			"key": "1234",
+			"up_to_date": true,
+			"unknown_env": ["zlib"],
+			"env": ["CC=x86_64-linux-musl-gcc"]
+		}]
+	}`, string(data))
+
+	// The key and unknown environment are left out when empty.
+	plan.Recipes[0].Key = ""
+	plan.Recipes[0].UnknownEnv = nil
+	data, err = json.Marshal(plan.Recipes[0])
+	require.NoError(t, err)
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &fields))
+	assert.NotContains(t, fields, "key")
+	assert.NotContains(t, fields, "unknown_env")
+}
@@ -2,6 +2,7 @@ package builder
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/andrew-d/sbuild/types"
 )
@@ -42,6 +43,46 @@ func dependencyNames(name, platform, arch string) []string {
 	return depNames
 }
 
+// Returns the names of all dependencies of the given recipe, without
+// duplicates, ordered such that every recipe comes before the recipes it
+// depends on.  This is the order in which libraries must be passed to a static
+// link.  Ties are broken by the order in which dependencies are declared.
+func linkOrder(name, platform, arch string) []string {
+	visited := make(map[string]bool)
+	var order []string
+
+	var visit func(string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+
+		recipe, ok := recipesRegistry[name]
+		if !ok {
+			panic(fmt.Sprintf("recipe with name '%s' not found", name))
+		}
+
+		// Visit dependencies backwards, so that they end up in the order
+		// they were declared once 'order' is reversed.
+		deps := recipe.Dependencies(platform, arch)
+		for i := len(deps) - 1; i >= 0; i-- {
+			visit(deps[i])
+		}
+		order = append(order, name)
+	}
+
+	visit(name)
+
+	// 'order' has every recipe after its dependencies, ending with the
+	// recipe itself, so reverse it and drop the recipe.
+	ret := make([]string, 0, len(order)-1)
+	for i := len(order) - 2; i >= 0; i-- {
+		ret = append(ret, order[i])
+	}
+	return ret
+}
+
 // Return the names of all binary dependencies.
 func AllBinaries() []string {
 	names := []string{}
@@ -54,3 +95,97 @@ func AllBinaries() []string {
 
 	return names
 }
+
+// Return the names of all registered recipes, in sorted order.
+func AllRecipes() []string {
+	names := make([]string, 0, len(recipesRegistry))
+	for name := range recipesRegistry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// ReverseDependencies returns the names of all registered recipes that depend,
+// directly or indirectly, on the named recipe, in sorted order.  Returns an
+// error if any recipe depends on a recipe that doesn't exist.
+func ReverseDependencies(name, platform, arch string) ([]string, error) {
+	if _, ok := recipesRegistry[name]; !ok {
+		return nil, fmt.Errorf("builder: recipe %s does not exist", name)
+	}
+
+	// The graph maps each recipe to the recipes that directly depend on it.
+	depgraph, err := recipeGraph(AllRecipes(), platform, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	visited := map[string]bool{name: true}
+	queue := []string{name}
+	for len(queue) > 0 {
+		curr := queue[0]
+		queue = queue[1:]
+
+		for _, dependent := range depgraph[curr] {
+			if !visited[dependent] {
+				visited[dependent] = true
+				names = append(names, dependent)
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// DependencyPaths returns every chain of dependencies through which one recipe
+// depends on another.  Each path starts with 'from' and ends with 'to'.
+// Returns no paths if 'from' does not depend on 'to', and an error if any of
+// its dependencies don't exist.
+func DependencyPaths(from, to, platform, arch string) ([][]string, error) {
+	for _, name := range []string{from, to} {
+		if _, ok := recipesRegistry[name]; !ok {
+			return nil, fmt.Errorf("builder: recipe %s does not exist", name)
+		}
+	}
+
+	paths := [][]string{}
+	onPath := make(map[string]bool)
+
+	var visit func([]string) error
+	visit = func(path []string) error {
+		curr := path[len(path)-1]
+		if curr == to {
+			paths = append(paths, append([]string(nil), path...))
+			return nil
+		}
+
+		// Guard against dependency cycles.
+		if onPath[curr] {
+			return nil
+		}
+		onPath[curr] = true
+		defer delete(onPath, curr)
+
+		recipe, ok := recipesRegistry[curr]
+		if !ok {
+			return fmt.Errorf("builder: recipe %s does not exist", curr)
+		}
+		for _, dep := range recipe.Dependencies(platform, arch) {
+			if err := visit(append(path, dep)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if from != to {
+		if err := visit([]string{from}); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,148 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andrew-d/sbuild/config"
+	"github.com/andrew-d/sbuild/env"
+	"github.com/andrew-d/sbuild/types"
+)
+
+// Replaces the recipe registry for the duration of a test, returning a
+// function that restores it.
+func withTestRegistry(recipes ...*testRecipe) func() {
+	old := recipesRegistry
+	recipesRegistry = make(map[string]types.Recipe)
+	for _, r := range recipes {
+		RegisterRecipe(r)
+	}
+
+	return func() {
+		recipesRegistry = old
+	}
+}
+
+func newTestRecipe(name string, deps ...string) *testRecipe {
+	return &testRecipe{
+		info: types.RecipeInfo{Name: name},
+		deps: deps,
+	}
+}
+
+func TestReverseDependencies(t *testing.T) {
+	defer withTestRegistry(
+		newTestRecipe("ncurses"),
+		newTestRecipe("readline", "ncurses"),
+		newTestRecipe("openssl"),
+		newTestRecipe("socat", "openssl", "readline", "ncurses"),
+	)()
+
+	names, err := ReverseDependencies("ncurses", "linux", "amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"readline", "socat"}, names)
+
+	names, err = ReverseDependencies("socat", "linux", "amd64")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, err = ReverseDependencies("zlib", "linux", "amd64")
+	assert.Error(t, err)
+}
+
+func TestReverseDependenciesInvalidGraph(t *testing.T) {
+	// Cycles don't loop forever.
+	restore := withTestRegistry(
+		newTestRecipe("a", "b"),
+		newTestRecipe("b", "a"),
+		newTestRecipe("c", "a"),
+	)
+	names, err := ReverseDependencies("a", "linux", "amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, names)
+	restore()
+
+	// Unknown dependencies are an error, not a panic.
+	defer withTestRegistry(
+		newTestRecipe("a"),
+		newTestRecipe("b", "a", "missing"),
+	)()
+	_, err = ReverseDependencies("a", "linux", "amd64")
+	assert.Error(t, err)
+	_, err = DependencyPaths("b", "a", "linux", "amd64")
+	assert.Error(t, err)
+}
+
+func TestDependencyPaths(t *testing.T) {
+	defer withTestRegistry(
+		newTestRecipe("ncurses"),
+		newTestRecipe("readline", "ncurses"),
+		newTestRecipe("openssl"),
+		newTestRecipe("socat", "openssl", "readline", "ncurses"),
+	)()
+
+	paths, err := DependencyPaths("socat", "ncurses", "linux", "amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"socat", "readline", "ncurses"},
+		{"socat", "ncurses"},
+	}, paths)
+
+	paths, err = DependencyPaths("openssl", "ncurses", "linux", "amd64")
+	assert.NoError(t, err)
+	assert.Empty(t, paths)
+}
+
+func TestLinkOrder(t *testing.T) {
+	defer withTestRegistry(
+		newTestRecipe("ncurses"),
+		newTestRecipe("readline", "ncurses"),
+		newTestRecipe("crypto"),
+		newTestRecipe("ssl", "crypto"),
+		newTestRecipe("socat", "ncurses", "ssl", "readline"),
+	)()
+
+	// Every recipe comes before its dependencies, without duplicates, even
+	// though ncurses is declared before readline.
+	assert.Equal(t,
+		[]string{"ssl", "crypto", "readline", "ncurses"},
+		linkOrder("socat", "linux", "amd64"))
+	assert.Equal(t, []string{"ncurses"}, linkOrder("readline", "linux", "amd64"))
+	assert.Empty(t, linkOrder("ncurses", "linux", "amd64"))
+}
+
+func TestSetupBuildLibs(t *testing.T) {
+	library := func(name string, exports types.LibraryExports, deps ...string) *testRecipe {
+		r := newTestRecipe(name, deps...)
+		r.info.Library = true
+		r.info.Exports = exports
+		return r
+	}
+
+	defer withTestRegistry(
+		library("ncurses", types.LibraryExports{
+			IncludeDirs: []string{"include/ncurses"},
+			Libs:        []string{"ncurses"},
+		}),
+		library("readline", types.LibraryExports{Libs: []string{"readline"}}, "ncurses"),
+		library("openssl", types.LibraryExports{Libs: []string{"ssl", "crypto"}}),
+		newTestRecipe("socat", "openssl", "ncurses", "readline"),
+	)()
+
+	ctx := &context{
+		rootEnv:    env.Empty(),
+		config:     &config.BuildConfig{BuildDir: "/build", Platform: "linux", Arch: "amd64"},
+		packageEnv: make(map[string]map[string]string),
+		buildKeys:  make(map[string]string),
+	}
+
+	setup := ctx.setupBuild("socat")
+	assert.Equal(t, "-lssl -lcrypto -lreadline -lncurses", setup.Libs)
+	assert.Equal(t, setup.Libs, setup.Env.Get("LIBS"))
+	assert.Contains(t, setup.Env.Get("CPPFLAGS"), "-I/build/sysroot/socat/usr/include/ncurses")
+
+	setup = ctx.setupBuild("ncurses")
+	assert.Empty(t, setup.Libs)
+	assert.Empty(t, setup.Env.Get("LIBS"))
+}
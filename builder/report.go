@@ -0,0 +1,311 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrew-d/sbuild/types"
+)
+
+// Name of the file, in the build directory, that the report of the most
+// recent build is written to.
+const reportFile = "build-report.json"
+
+// Possible values for the status of a recipe in a Report.
+const (
+	// Built during this run.
+	StatusBuilt = "built"
+
+	// Restored from a cached build with the same key.
+	StatusCached = "cached"
+
+	// Already built by a previous, resumed run.
+	StatusAlreadyBuilt = "already_built"
+
+	// Not rebuilt because of --from or --only, and the previous build was
+	// reused instead.
+	StatusReused = "reused"
+
+	// Failed to build.
+	StatusFailed = "failed"
+
+	// Never started, because another recipe failed first.
+	StatusNotBuilt = "not_built"
+)
+
+// Report describes the result of a single build, for consumption by other
+// tools.
+type Report struct {
+	Platform        string    `json:"platform"`
+	Arch            string    `json:"arch"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Succeeded       bool      `json:"succeeded"`
+	Error           string    `json:"error,omitempty"`
+
+	// All recipes that were part of the build, sorted by name.
+	Recipes []*RecipeReport `json:"recipes"`
+}
+
+// RecipeReport describes the result of building a single recipe.
+type RecipeReport struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Key     string `json:"key,omitempty"`
+	Status  string `json:"status"`
+
+	// Set if the recipe failed.  FailedPhase is empty if the failure happened
+	// outside of a phase (for example, while identifying the toolchain).
+	FailedPhase string `json:"failed_phase,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// Wall-clock times of the phases that were run during this build.
+	Phases []*PhaseTiming `json:"phases"`
+
+	Sources []*ReportSource `json:"sources"`
+
+	// Environment variables exported to dependents.
+	Env map[string]string `json:"env"`
+
+	// The environment that the recipe's environment was based on, if the
+	// build was hermetic.
+	BaseEnv map[string]string `json:"base_env,omitempty"`
+
+	// The results of inspecting every ELF file in the output directory, if
+	// the recipe was built.
+	ELFChecks []*ELFCheck `json:"elf_checks"`
+
+	// The results of the recipe's tests, if they were run.
+	Tests []*TestResult `json:"tests,omitempty"`
+
+	// The recipe's output directory, and every file in it.
+	OutputDir string        `json:"output_dir"`
+	Outputs   []*OutputFile `json:"outputs"`
+}
+
+// PhaseTiming is the wall-clock time taken by a single phase.
+type PhaseTiming struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// ReportSource is a single source of a recipe.
+type ReportSource struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	SHA256   string `json:"sha256"`
+}
+
+// OutputFile is a single file in a recipe's output directory.
+type OutputFile struct {
+	// Path relative to the recipe's output directory.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// reportBuilder collects a Report while a build is running.  All methods may
+// be called concurrently.
+type reportBuilder struct {
+	lock    sync.Mutex
+	report  *Report
+	recipes map[string]*RecipeReport
+}
+
+func newReportBuilder(platform, arch string) *reportBuilder {
+	return &reportBuilder{
+		report: &Report{
+			Platform: platform,
+			Arch:     arch,
+			Started:  time.Now(),
+		},
+		recipes: make(map[string]*RecipeReport),
+	}
+}
+
+// Add adds a recipe to the report, given its expanded sources, its base
+// environment (nil unless the build is hermetic) and its output directory.
+// Recipes start out as not built.
+func (b *reportBuilder) Add(info *types.RecipeInfo, sources []string, baseEnv map[string]string, outDir string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	r := &RecipeReport{
+		Name:      info.Name,
+		Version:   info.Version,
+		Status:    StatusNotBuilt,
+		Phases:    []*PhaseTiming{},
+		Sources:   []*ReportSource{},
+		Env:       map[string]string{},
+		ELFChecks: []*ELFCheck{},
+		BaseEnv:   baseEnv,
+		OutputDir: outDir,
+		Outputs:   []*OutputFile{},
+	}
+	for i, source := range sources {
+		filename, url := SplitSource(source)
+		r.Sources = append(r.Sources, &ReportSource{
+			URL:      url,
+			Filename: filename,
+			SHA256:   info.Sums[i],
+		})
+	}
+
+	b.recipes[r.Name] = r
+	b.report.Recipes = append(b.report.Recipes, r)
+}
+
+// Phase records how long a phase of the given recipe took.
+func (b *reportBuilder) Phase(name string, p phase, d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	r := b.recipes[name]
+	r.Phases = append(r.Phases, &PhaseTiming{
+		Phase:   string(p),
+		Seconds: d.Seconds(),
+	})
+}
+
+// Verify records the results of inspecting the outputs of the given recipe.
+func (b *reportBuilder) Verify(name string, checks []*ELFCheck) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.recipes[name].ELFChecks = checks
+}
+
+// Tests records the results of the given recipe's tests.
+func (b *reportBuilder) Tests(name string, results []*TestResult) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.recipes[name].Tests = results
+}
+
+// Finish records that the given recipe finished successfully.
+func (b *reportBuilder) Finish(name, status, key string, exported map[string]string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	r := b.recipes[name]
+	r.Status = status
+	r.Key = key
+	for k, v := range exported {
+		r.Env[k] = v
+	}
+}
+
+// Fail records that the given recipe failed.
+func (b *reportBuilder) Fail(name string, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	r := b.recipes[name]
+	r.Status = StatusFailed
+	r.Error = err.Error()
+	if perr, ok := err.(*PhaseError); ok {
+		r.FailedPhase = perr.Phase
+		r.Error = perr.Err.Error()
+	}
+}
+
+// Done finishes the report, given the result of the build, and lists the
+// outputs of every recipe that succeeded.
+func (b *reportBuilder) Done(buildErr error) *Report {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.report.DurationSeconds = time.Since(b.report.Started).Seconds()
+	b.report.Succeeded = buildErr == nil
+	if buildErr != nil {
+		b.report.Error = buildErr.Error()
+	}
+
+	sort.Slice(b.report.Recipes, func(i, j int) bool {
+		return b.report.Recipes[i].Name < b.report.Recipes[j].Name
+	})
+
+	for _, r := range b.report.Recipes {
+		if r.Status == StatusFailed || r.Status == StatusNotBuilt {
+			continue
+		}
+
+		outputs, err := listOutputs(r.OutputDir)
+		if err != nil {
+			log.WithField("recipe", r.Name).Warn("Could not list outputs")
+			continue
+		}
+		r.Outputs = outputs
+	}
+
+	return b.report
+}
+
+// Write writes the report as JSON to the given path.
+func (r *Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Returns every regular file in the given directory, with its size and hash.
+func listOutputs(dir string) ([]*OutputFile, error) {
+	ret := []*OutputFile{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, &OutputFile{
+			Path:   filepath.ToSlash(rel),
+			Size:   info.Size(),
+			SHA256: sum,
+		})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	return ret, err
+}
+
+// Returns the hex-encoded SHA-256 hash of the given file.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
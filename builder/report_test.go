@@ -0,0 +1,73 @@
+package builder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/types"
+)
+
+func TestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	outDir := filepath.Join(dir, "out", "foo")
+	require.NoError(t, os.MkdirAll(filepath.Join(outDir, "bin"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outDir, "bin", "foo"), []byte("hello"), 0755))
+
+	b := newReportBuilder("linux", "amd64")
+	b.Add(&types.RecipeInfo{
+		Name:    "foo",
+		Version: "1.0",
+		Sums:    []string{"abcd"},
+	}, []string{"foo.tgz::http://example.com/foo-1.0.tar.gz"}, nil, outDir)
+	b.Add(&types.RecipeInfo{Name: "bar", Version: "2.0"}, nil, nil, "")
+	b.Add(&types.RecipeInfo{Name: "baz", Version: "3.0"}, nil, nil, "")
+
+	b.Phase("foo", phaseBuild, 2*time.Second)
+	b.Finish("foo", StatusBuilt, "key", map[string]string{"FOO": "1"})
+	b.Fail("bar", &PhaseError{Recipe: "bar", Phase: "build", Err: errors.New("make failed")})
+
+	report := b.Done(errors.New("build failed"))
+	assert.False(t, report.Succeeded)
+	assert.Equal(t, "build failed", report.Error)
+
+	// Recipes are sorted by name.
+	require.Len(t, report.Recipes, 3)
+	bar, baz, foo := report.Recipes[0], report.Recipes[1], report.Recipes[2]
+
+	assert.Equal(t, StatusFailed, bar.Status)
+	assert.Equal(t, "build", bar.FailedPhase)
+	assert.Equal(t, "make failed", bar.Error)
+
+	assert.Equal(t, StatusNotBuilt, baz.Status)
+
+	assert.Equal(t, StatusBuilt, foo.Status)
+	assert.Equal(t, "key", foo.Key)
+	assert.Equal(t, map[string]string{"FOO": "1"}, foo.Env)
+	assert.Equal(t, []*PhaseTiming{{Phase: "build", Seconds: 2}}, foo.Phases)
+	assert.Equal(t, []*ReportSource{{
+		URL:      "http://example.com/foo-1.0.tar.gz",
+		Filename: "foo.tgz",
+		SHA256:   "abcd",
+	}}, foo.Sources)
+	assert.Equal(t, []*OutputFile{{
+		Path:   "bin/foo",
+		Size:   5,
+		SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}}, foo.Outputs)
+
+	path := filepath.Join(dir, reportFile)
+	require.NoError(t, report.Write(path))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"failed_phase": "build"`)
+}
@@ -0,0 +1,389 @@
+package builder
+
+import (
+	"bytes"
+	stdcontext "context"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/andrew-d/sbuild/config"
+	"github.com/andrew-d/sbuild/util"
+)
+
+// Kinds of difference between the outputs of two builds.
+const (
+	DiffOnlyInFirst  = "only_in_first"
+	DiffOnlyInSecond = "only_in_second"
+	DiffContent      = "content"
+)
+
+// ReproReport is the result of checking whether a build is reproducible.
+type ReproReport struct {
+	Platform string `json:"platform"`
+	Arch     string `json:"arch"`
+
+	// The build directories of the two builds.
+	BuildDirs [2]string `json:"build_dirs"`
+
+	// The number of files that were compared, and those that differ.
+	Files       int               `json:"files"`
+	Differences []*FileDifference `json:"differences"`
+}
+
+// Reproducible returns whether both builds produced identical outputs.
+func (r *ReproReport) Reproducible() bool {
+	return len(r.Differences) == 0
+}
+
+// FileDifference describes an output file that differs between two builds.
+type FileDifference struct {
+	// Path relative to the output directory.
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+
+	// For ELF files, the sections whose contents differ, or that only exist
+	// in one of the builds.
+	Sections []string `json:"sections,omitempty"`
+
+	// Whether either build's copy of the file contains the path of its build
+	// directory, or the date or time when it was built.
+	EmbedsBuildPath bool `json:"embeds_build_path"`
+	EmbedsTimestamp bool `json:"embeds_timestamp"`
+}
+
+// A variation in the environment of one of the builds that CheckReproducible
+// runs.
+type reproVariant struct {
+	// Appended to the build directory.  The directories have different
+	// lengths, to catch paths embedded in fixed-size fields too.
+	dir   string
+	umask int
+
+	// Variables set in the base environment of every recipe.  Variables that
+	// reproducible builds pin (LC_ALL, TZ and SOURCE_DATE_EPOCH) would be
+	// overridden, so these are ones that builds sometimes embed (e.g.
+	// "compiled by user@host") and that nothing pins.  The order of the
+	// environment can't be varied, since commands always get it sorted.
+	env map[string]string
+}
+
+var reproVariants = [2]reproVariant{
+	{dir: "1", umask: 022, env: map[string]string{
+		"USER":    "sbuild",
+		"LOGNAME": "sbuild",
+	}},
+	{dir: "second-build", umask: 002, env: map[string]string{
+		"USER":    "sbuild-repro",
+		"LOGNAME": "sbuild-repro",
+	}},
+}
+
+// CheckReproducible builds the given recipes twice, with reproducible builds
+// enabled, and compares every output file of the two builds.
+//
+// The builds run one after another in separate build directories under the
+// configuration's build directory (sharing its source cache), and differ in
+// their build path, umask, the user name in the base environment of every
+// recipe and, since they can't run at the same time, when they're built.
+func CheckReproducible(runCtx stdcontext.Context, recipes []string, base *config.BuildConfig) (*ReproReport, error) {
+	report := &ReproReport{
+		Platform: base.Platform,
+		Arch:     base.Arch,
+	}
+
+	var (
+		configs [2]*config.BuildConfig
+		started [2]time.Time
+	)
+	for i, variant := range reproVariants {
+		conf := variant.config(base)
+		configs[i] = conf
+		report.BuildDirs[i] = conf.BuildDir
+
+		// Nothing from a previous check may be reused.
+		if err := os.RemoveAll(conf.BuildDir); err != nil {
+			return nil, err
+		}
+
+		log.WithFields(logrus.Fields{
+			"build":     i + 1,
+			"build_dir": conf.BuildDir,
+		}).Info("Starting reproducibility build")
+
+		started[i] = time.Now()
+		restore := variant.apply()
+		err := Build(runCtx, recipes, conf)
+		restore()
+		if err != nil {
+			return nil, err
+		}
+	}
+	finished := time.Now()
+
+	err := compareOutputs(report, configs, started[0], finished)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Returns the configuration of the build for this variant, based on the given
+// configuration.
+func (v reproVariant) config(base *config.BuildConfig) *config.BuildConfig {
+	conf := *base
+	conf.BuildDir = filepath.Join(base.BuildDir, "repro", v.dir)
+	conf.OutputDir = filepath.Join(conf.BuildDir, "out")
+	conf.CacheDir = base.SourceCacheDir()
+	conf.LogDir = filepath.Join(conf.BuildDir, "logs")
+	conf.Reproducible = true
+	conf.Resume = false
+	conf.From = nil
+	conf.Only = nil
+	conf.ExtraEnv = make(map[string]string)
+	for k, val := range base.ExtraEnv {
+		conf.ExtraEnv[k] = val
+	}
+	for k, val := range v.env {
+		conf.ExtraEnv[k] = val
+	}
+	return &conf
+}
+
+// Applies this variant to our process, returning a function that undoes it.
+func (v reproVariant) apply() func() {
+	oldUmask := util.SetUmask(v.umask)
+	return func() {
+		util.SetUmask(oldUmask)
+	}
+}
+
+// Compares the output directories of the two builds, adding every file that
+// differs to the report.
+func compareOutputs(report *ReproReport, configs [2]*config.BuildConfig, started, finished time.Time) error {
+	var files [2]map[string]bool
+	for i, conf := range configs {
+		outputs, err := listOutputs(conf.OutputDir)
+		if err != nil {
+			return err
+		}
+
+		files[i] = make(map[string]bool)
+		for _, f := range outputs {
+			files[i][f.Path] = true
+		}
+	}
+
+	all := make(map[string]bool)
+	for _, m := range files {
+		for path := range m {
+			all[path] = true
+		}
+	}
+	paths := make([]string, 0, len(all))
+	for path := range all {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	report.Files = len(paths)
+	report.Differences = []*FileDifference{}
+	for _, path := range paths {
+		switch {
+		case !files[1][path]:
+			report.Differences = append(report.Differences, &FileDifference{
+				Path: path,
+				Kind: DiffOnlyInFirst,
+			})
+
+		case !files[0][path]:
+			report.Differences = append(report.Differences, &FileDifference{
+				Path: path,
+				Kind: DiffOnlyInSecond,
+			})
+
+		default:
+			diff, err := compareFile(path, configs, started, finished)
+			if err != nil {
+				return err
+			}
+			if diff != nil {
+				report.Differences = append(report.Differences, diff)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Compares a single output file of the two builds, returning nil if they're
+// identical.
+func compareFile(path string, configs [2]*config.BuildConfig, started, finished time.Time) (*FileDifference, error) {
+	var data [2][]byte
+	for i, conf := range configs {
+		var err error
+		data[i], err = ioutil.ReadFile(filepath.Join(conf.OutputDir, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bytes.Equal(data[0], data[1]) {
+		return nil, nil
+	}
+
+	diff := &FileDifference{
+		Path:     path,
+		Kind:     DiffContent,
+		Sections: elfSectionDiff(data[0], data[1]),
+	}
+	for i, conf := range configs {
+		if bytes.Contains(data[i], []byte(conf.BuildDir)) {
+			diff.EmbedsBuildPath = true
+		}
+		if containsTimestamp(data[i], data[1-i], started, finished) {
+			diff.EmbedsTimestamp = true
+		}
+	}
+	return diff, nil
+}
+
+// Returns the names of the sections that differ between two ELF files, or nil
+// if either isn't an ELF file.
+func elfSectionDiff(a, b []byte) []string {
+	fa, err := elf.NewFile(bytes.NewReader(a))
+	if err != nil {
+		return nil
+	}
+	defer fa.Close()
+
+	fb, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	defer fb.Close()
+
+	sections := func(f *elf.File) map[string][]byte {
+		ret := make(map[string][]byte)
+		for _, s := range f.Sections {
+			if s.Type == elf.SHT_NOBITS || s.Name == "" {
+				continue
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(s.Open(), int64(s.Size)))
+			if err != nil {
+				continue
+			}
+			ret[s.Name] = data
+		}
+		return ret
+	}
+	sa, sb := sections(fa), sections(fb)
+
+	var ret []string
+	for name, data := range sa {
+		if other, ok := sb[name]; !ok || !bytes.Equal(data, other) {
+			ret = append(ret, name)
+		}
+	}
+	for name := range sb {
+		if _, ok := sa[name]; !ok {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+
+	// The files differ, so if no section does, the headers must.
+	if len(ret) == 0 {
+		ret = []string{"(headers)"}
+	}
+	return ret
+}
+
+// Returns whether the given data contains the date (in the formats used by
+// __DATE__, `date` and ISO 8601) or a Unix timestamp from the given time
+// range where it differs from the other build's copy.  Only looking where the
+// builds differ keeps arbitrary data in large files from looking like a
+// timestamp.
+func containsTimestamp(data, other []byte, start, end time.Time) bool {
+	// Whether any of the given bytes differ from the other build's.
+	differs := func(off, n int) bool {
+		for i := off; i < off+n; i++ {
+			if i >= len(other) || data[i] != other[i] {
+				return true
+			}
+		}
+		return false
+	}
+
+	formats := []string{"Jan _2 2006", "Mon Jan _2", "2006-01-02"}
+	dates := make(map[string]bool)
+	for _, loc := range []*time.Location{time.UTC, time.Local} {
+		for t := start; t.Before(end); t = t.Add(time.Hour) {
+			for _, format := range formats {
+				dates[t.In(loc).Format(format)] = true
+			}
+		}
+		for _, format := range formats {
+			dates[end.In(loc).Format(format)] = true
+		}
+	}
+	for date := range dates {
+		for off := 0; off < len(data); {
+			i := bytes.Index(data[off:], []byte(date))
+			if i < 0 {
+				break
+			}
+			if differs(off+i, len(date)) {
+				return true
+			}
+			off += i + 1
+		}
+	}
+
+	// Look for 32-bit timestamps, in both byte orders.
+	lo, hi := uint32(start.Unix()), uint32(end.Unix())
+	for i := 0; i+4 <= len(data); i += 4 {
+		if !differs(i, 4) {
+			continue
+		}
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if v := order.Uint32(data[i:]); v >= lo && v <= hi {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String returns a one-line description of the difference.
+func (d *FileDifference) String() string {
+	switch d.Kind {
+	case DiffOnlyInFirst:
+		return d.Path + ": only in first build"
+	case DiffOnlyInSecond:
+		return d.Path + ": only in second build"
+	}
+
+	var notes []string
+	if len(d.Sections) > 0 {
+		notes = append(notes, "sections "+strings.Join(d.Sections, ", "))
+	}
+	if d.EmbedsBuildPath {
+		notes = append(notes, "embeds build path")
+	}
+	if d.EmbedsTimestamp {
+		notes = append(notes, "embeds timestamp")
+	}
+	if len(notes) == 0 {
+		return d.Path + ": content differs"
+	}
+	return fmt.Sprintf("%s: content differs (%s)", d.Path, strings.Join(notes, "; "))
+}
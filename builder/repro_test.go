@@ -0,0 +1,140 @@
+package builder
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+func TestCompareOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var configs [2]*config.BuildConfig
+	for i, name := range []string{"a", "bb"} {
+		configs[i] = &config.BuildConfig{
+			BuildDir:  filepath.Join(dir, name),
+			OutputDir: filepath.Join(dir, name, "out"),
+		}
+	}
+	write := func(i int, path, contents string) {
+		path = filepath.Join(configs[i].OutputDir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	write(0, "same", "hello")
+	write(1, "same", "hello")
+	write(0, "path", "built in "+configs[0].BuildDir)
+	write(1, "path", "built in "+configs[1].BuildDir)
+	write(0, "date", "built on Jan  2 2006")
+	write(1, "date", "built on Jan  3 2006")
+	write(0, "first", "")
+	write(1, "second", "")
+
+	started := time.Date(2006, 1, 2, 12, 0, 0, 0, time.UTC)
+	report := &ReproReport{}
+	require.NoError(t, compareOutputs(report, configs, started, started.Add(time.Minute)))
+
+	assert.Equal(t, 5, report.Files)
+	assert.False(t, report.Reproducible())
+	assert.Equal(t, []*FileDifference{
+		{Path: "date", Kind: DiffContent, EmbedsTimestamp: true},
+		{Path: "first", Kind: DiffOnlyInFirst},
+		{Path: "path", Kind: DiffContent, EmbedsBuildPath: true},
+		{Path: "second", Kind: DiffOnlyInSecond},
+	}, report.Differences)
+}
+
+func TestElfSectionDiff(t *testing.T) {
+	// Use our own binary as an ELF file, and change a byte in one section.
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Skip("test binary is not an ELF file")
+	}
+	section := f.Section(".rodata")
+	f.Close()
+	require.NotNil(t, section)
+
+	a, err := ioutil.ReadFile(exe)
+	require.NoError(t, err)
+	b := append([]byte(nil), a...)
+	b[section.Offset] ^= 0xff
+
+	assert.Equal(t, []string{".rodata"}, elfSectionDiff(a, b))
+	assert.Nil(t, elfSectionDiff([]byte("not elf"), b))
+}
+
+func TestContainsTimestamp(t *testing.T) {
+	start := time.Date(2006, 1, 2, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	stamp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(stamp, uint32(start.Unix()+60))
+
+	// Data that happens to look like a timestamp, or a date, doesn't count
+	// where both builds are the same.
+	a := append(append([]byte("same"), stamp...), "Jan  2 2006 xxxx"...)
+	b := append([]byte(nil), a...)
+	b[len(b)-1] = 'y'
+	assert.False(t, containsTimestamp(a, b, start, end))
+
+	// But it does where they differ.
+	b = append([]byte(nil), a...)
+	b[5]++
+	assert.True(t, containsTimestamp(a, b, start, end))
+
+	b = append([]byte(nil), a...)
+	b[len("same")+4+len("Jan  ")] = '3'
+	assert.True(t, containsTimestamp(a, b, start, end))
+}
+
+func TestReproVariantsEnv(t *testing.T) {
+	defer withTestRegistry(newTestRecipe("socat"))()
+
+	base := &config.BuildConfig{
+		BuildDir: "/build",
+		Platform: "linux",
+		Arch:     "amd64",
+		Hermetic: true,
+		ExtraEnv: map[string]string{"FOO": "bar"},
+	}
+
+	var (
+		envs  [2][]string
+		users [2][2]string
+	)
+	for i, variant := range reproVariants {
+		conf := variant.config(base)
+		ctx := &context{
+			rootEnv:    baseEnv(conf),
+			config:     conf,
+			packageEnv: make(map[string]map[string]string),
+			buildKeys:  make(map[string]string),
+		}
+
+		setup := ctx.setupBuild("socat")
+		assert.Equal(t, "bar", setup.Env.Get("FOO"))
+		assert.Equal(t, "UTC", setup.Env.Get("TZ"))
+		assert.Equal(t, "C", setup.Env.Get("LC_ALL"))
+		envs[i] = setup.Env.AsSlice()
+		users[i] = [2]string{setup.Env.Get("USER"), setup.Env.Get("LOGNAME")}
+	}
+
+	assert.NotEqual(t, envs[0], envs[1])
+	assert.NotEqual(t, users[0][0], users[1][0])
+	assert.NotEqual(t, users[0][1], users[1][1])
+	assert.Equal(t, map[string]string{"FOO": "bar"}, base.ExtraEnv)
+}
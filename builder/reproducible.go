@@ -0,0 +1,61 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/andrew-d/sbuild/config"
+	"github.com/andrew-d/sbuild/types"
+)
+
+// The path that the build directory is replaced with in the outputs of
+// reproducible builds (e.g. in debug information and __FILE__).
+const reproducibleBuildDir = "/sbuild"
+
+// Returns the compiler flags that make the output of a reproducible build of
+// the given recipe independent of where it was built.
+func reproducibleFlags(name string, config *config.BuildConfig) string {
+	// The compiler sees absolute paths, so a relative build directory would
+	// never match them.
+	buildDir, err := filepath.Abs(config.BuildDir)
+	if err != nil {
+		buildDir = config.BuildDir
+	}
+
+	// -ffile-prefix-map covers debug information and macros, but is only
+	// supported by newer compilers, so we also pass -fdebug-prefix-map.
+	return fmt.Sprintf(
+		" -frandom-seed=build-%s-%s-%s -ffile-prefix-map=%s=%s -fdebug-prefix-map=%s=%s ",
+		name,
+		config.Platform,
+		config.Arch,
+		buildDir, reproducibleBuildDir,
+		buildDir, reproducibleBuildDir,
+	)
+}
+
+// Returns the value of SOURCE_DATE_EPOCH for the given recipe: the date given
+// by the recipe, or else the modification time of the newest file in its
+// unpacked sources.  Symlinks are ignored, since the links to the downloaded
+// sources are created when the build runs.
+func sourceDateEpoch(info *types.RecipeInfo, sourceDir string) (int64, error) {
+	if info.SourceDateEpoch != 0 {
+		return info.SourceDateEpoch, nil
+	}
+
+	var newest int64
+	err := filepath.Walk(sourceDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if t := fi.ModTime().Unix(); t > newest {
+			newest = t
+		}
+		return nil
+	})
+	return newest, err
+}
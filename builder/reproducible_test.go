@@ -0,0 +1,60 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/config"
+	"github.com/andrew-d/sbuild/types"
+)
+
+func TestSourceDateEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	older := time.Unix(1400000000, 0)
+	newer := time.Unix(1500000000, 0)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "src"), 0755))
+	for path, mtime := range map[string]time.Time{
+		"README":   older,
+		"src/main": newer,
+	} {
+		path = filepath.Join(dir, path)
+		require.NoError(t, ioutil.WriteFile(path, []byte("x"), 0644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	// Symlinks, like the ones to downloaded sources, are ignored.
+	require.NoError(t, os.Symlink("README", filepath.Join(dir, "source.tar.gz")))
+
+	epoch, err := sourceDateEpoch(&types.RecipeInfo{}, dir)
+	require.NoError(t, err)
+	assert.Equal(t, newer.Unix(), epoch)
+
+	// The recipe's date takes precedence.
+	epoch, err = sourceDateEpoch(&types.RecipeInfo{SourceDateEpoch: 1234}, dir)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1234), epoch)
+}
+
+func TestReproducibleFlagsRelativeBuildDir(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	flags := reproducibleFlags("zlib", &config.BuildConfig{
+		BuildDir: "build",
+		Platform: "linux",
+		Arch:     "amd64",
+	})
+	buildDir := filepath.Join(wd, "build")
+	assert.Contains(t, flags, " -ffile-prefix-map="+buildDir+"="+reproducibleBuildDir+" ")
+	assert.Contains(t, flags, " -fdebug-prefix-map="+buildDir+"="+reproducibleBuildDir+" ")
+}
@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrew-d/sbuild/env"
+	"github.com/andrew-d/sbuild/sandbox"
+)
+
+// Returns what should be visible inside the sandbox that the given recipe's
+// commands run in: its source, staging and output directories and the HOME
+// of hermetic builds (read-write),
+// and its sysroot, the source cache, the toolchain, the default set of host
+// paths and any configured extra paths (read-only).
+func (ctx *context) sandboxMounts(setup *buildSetup) *sandbox.Mounts {
+	ret := &sandbox.Mounts{
+		ReadWrite: []string{setup.SourceDir, setup.StagingDir, setup.OutDir},
+		ReadOnly:  sandbox.DefaultPaths(),
+	}
+
+	// Sources in the source directory are symlinks into the cache.
+	ret.ReadOnly = append(ret.ReadOnly, setup.SysrootDir, ctx.config.SourceCacheDir())
+	if root := toolchainRoot(setup.compilerEnv); root != "" {
+		ret.ReadOnly = append(ret.ReadOnly, root)
+	}
+	ret.ReadOnly = append(ret.ReadOnly, ctx.config.SandboxPaths...)
+	if ctx.config.Hermetic {
+		ret.ReadWrite = append(ret.ReadWrite, homeDir(ctx.config))
+	}
+	return ret
+}
+
+// Returns the root directory of the toolchain that contains the compiler named
+// by the given environment (e.g. "/opt/cross" for "/opt/cross/bin/gcc"), or
+// an empty string if it can't be found or is part of the host system, which
+// the sandbox's default paths already cover.
+func toolchainRoot(e *env.Env) string {
+	fields := strings.Fields(e.Get("CC"))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+
+	root := filepath.Dir(filepath.Dir(path))
+	if root == "/" || root == "/usr" {
+		return ""
+	}
+	return root
+}
@@ -0,0 +1,135 @@
+package builder
+
+import (
+	"sort"
+)
+
+// scheduler runs a function for each node in a dependency graph, starting each
+// node as soon as all of its dependencies have finished.  At most 'jobs' nodes
+// will be run at once.
+type scheduler struct {
+	// Map of node --> nodes that directly depend on it.
+	dependents graph
+
+	// Number of dependencies of each node.
+	numDeps map[string]int
+
+	// Length of the longest chain of dependents starting at each node.  Nodes
+	// with longer chains are started first, since they gate the most work.
+	priority map[string]int
+
+	jobs int
+}
+
+func newScheduler(g graph, jobs int) *scheduler {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	s := &scheduler{
+		dependents: g,
+		numDeps:    make(map[string]int, len(g)),
+		priority:   make(map[string]int, len(g)),
+		jobs:       jobs,
+	}
+
+	for node, dependents := range g {
+		s.numDeps[node] += 0
+		for _, dependent := range dependents {
+			s.numDeps[dependent]++
+		}
+	}
+
+	var chainLength func(string) int
+	chainLength = func(node string) int {
+		if p, ok := s.priority[node]; ok {
+			return p
+		}
+
+		longest := 0
+		for _, dependent := range g[node] {
+			if l := chainLength(dependent); l > longest {
+				longest = l
+			}
+		}
+
+		s.priority[node] = longest + 1
+		return longest + 1
+	}
+	for node := range g {
+		chainLength(node)
+	}
+
+	return s
+}
+
+// Sorts the given nodes such that the highest-priority node is first.  Ties are
+// broken by name, so that the order is deterministic.
+func (s *scheduler) sortReady(nodes []string) {
+	sort.Slice(nodes, func(i, j int) bool {
+		pi, pj := s.priority[nodes[i]], s.priority[nodes[j]]
+		if pi != pj {
+			return pi > pj
+		}
+		return nodes[i] < nodes[j]
+	})
+}
+
+// run calls fn for each node in the graph.  If any call returns an error, no
+// new nodes will be started, and the first error will be returned once all
+// running calls have finished.
+func (s *scheduler) run(fn func(string) error) error {
+	type result struct {
+		node string
+		err  error
+	}
+
+	remaining := make(map[string]int, len(s.numDeps))
+	ready := []string{}
+	for node, n := range s.numDeps {
+		remaining[node] = n
+		if n == 0 {
+			ready = append(ready, node)
+		}
+	}
+
+	results := make(chan result)
+	running := 0
+
+	var firstErr error
+	for {
+		// Start as many nodes as we're allowed to.
+		s.sortReady(ready)
+		for firstErr == nil && running < s.jobs && len(ready) > 0 {
+			node := ready[0]
+			ready = ready[1:]
+			running++
+
+			go func(node string) {
+				results <- result{node, fn(node)}
+			}(node)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+
+		for _, dependent := range s.dependents[res.node] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	return firstErr
+}
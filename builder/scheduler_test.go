@@ -0,0 +1,105 @@
+package builder
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a -> b -> c, plus an independent d.  Edges point from a dependency to its
+// dependents.
+func testGraph() graph {
+	return graph{
+		"a": {"b"},
+		"b": {"c"},
+		"c": nil,
+		"d": nil,
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler(testGraph(), 1)
+	assert.Equal(t, 3, s.priority["a"])
+	assert.Equal(t, 2, s.priority["b"])
+	assert.Equal(t, 1, s.priority["c"])
+	assert.Equal(t, 1, s.priority["d"])
+}
+
+func TestSchedulerSerialOrder(t *testing.T) {
+	var order []string
+	s := newScheduler(testGraph(), 1)
+	err := s.run(func(node string) error {
+		order = append(order, node)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, order)
+}
+
+func TestSchedulerParallel(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		finished = map[string]bool{}
+		running  int
+		maxSeen  int
+	)
+
+	g := graph{
+		"a": {"d"},
+		"b": {"d"},
+		"c": {"d"},
+		"d": nil,
+	}
+	s := newScheduler(g, 2)
+	err := s.run(func(node string) error {
+		lock.Lock()
+		if node == "d" {
+			// Every dependency must have finished before we start.
+			assert.Len(t, finished, 3)
+		}
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		finished[node] = true
+		lock.Unlock()
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, finished, 4)
+	assert.Equal(t, 2, maxSeen)
+}
+
+func TestSchedulerError(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		started []string
+	)
+
+	buildErr := errors.New("build failed")
+	s := newScheduler(testGraph(), 1)
+	err := s.run(func(node string) error {
+		lock.Lock()
+		started = append(started, node)
+		lock.Unlock()
+
+		if node == "a" {
+			return buildErr
+		}
+		return nil
+	})
+
+	assert.Equal(t, buildErr, err)
+	assert.Equal(t, []string{"a"}, started)
+}
@@ -0,0 +1,187 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/andrew-d/sbuild/config"
+	"github.com/andrew-d/sbuild/sandbox"
+	"github.com/andrew-d/sbuild/types"
+)
+
+// The name of the TestResult for a recipe's upstream test suite.
+const upstreamCheckName = "check"
+
+// TestResult is the result of one of a recipe's tests.
+type TestResult struct {
+	// The test's command line, or "check" for the recipe's upstream test
+	// suite.
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Returns whether binaries built with the given configuration can run on
+// this machine.
+func nativeTarget(config *config.BuildConfig) bool {
+	return config.Platform == runtime.GOOS && config.Arch == runtime.GOARCH
+}
+
+// Returns whether the given recipe has any tests to run with this build's
+// configuration.
+func (ctx *context) hasTests(recipe types.Recipe) bool {
+	if !nativeTarget(ctx.config) {
+		return false
+	}
+
+	// In an empty root, every executable is run.
+	if len(recipe.Info().Tests) > 0 || ctx.config.EmptyRoot {
+		return true
+	}
+	_, ok := recipe.(types.CheckRecipe)
+	return ok && ctx.config.Check
+}
+
+// Runs all of the given recipe's tests against its outputs, and its upstream
+// test suite if checks are enabled, during the test phase.  Every test is
+// run, even if an earlier one fails.
+func (ctx *context) runTests(name string, recipe types.Recipe, buildCtx *types.BuildContext, outDir string, logs *recipeLog) error {
+	var (
+		results []*TestResult
+		failed  []string
+	)
+	record := func(testName string, err error) {
+		result := &TestResult{Name: testName, Passed: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			failed = append(failed, testName)
+			log.WithFields(logrus.Fields{
+				"recipe": name,
+				"test":   testName,
+				"err":    err,
+			}).Error("Test failed")
+		}
+		results = append(results, result)
+	}
+
+	info := recipe.Info()
+	runner := &smokeTestRunner{
+		outDir:    outDir,
+		environ:   buildCtx.Env.AsSlice(),
+		emptyRoot: ctx.config.EmptyRoot,
+		dataFiles: info.DataFiles,
+		logs:      logs,
+	}
+	tests := info.Tests
+	if ctx.config.EmptyRoot {
+		probes, err := probeTests(outDir, ctx.config.Arch, tests)
+		if err != nil {
+			return err
+		}
+		tests = append(append([]types.TestCommand(nil), tests...), probes...)
+	}
+	for _, test := range tests {
+		record(strings.Join(test.Args, " "), runner.run(test))
+	}
+
+	if checker, ok := recipe.(types.CheckRecipe); ok && ctx.config.Check {
+		record(upstreamCheckName, checker.Check(buildCtx))
+	}
+
+	ctx.report.Tests(name, results)
+	if len(failed) > 0 {
+		return fmt.Errorf("tests failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Returns tests that run `--version` for every executable in the given output
+// directory that isn't run by one of the given tests.
+func probeTests(outDir, arch string, tests []types.TestCommand) ([]types.TestCommand, error) {
+	tested := make(map[string]bool)
+	for _, test := range tests {
+		if len(test.Args) > 0 {
+			tested[path.Clean(test.Args[0])] = true
+		}
+	}
+
+	checks, err := verifyOutputs(outDir, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []types.TestCommand
+	for _, check := range checks {
+		if check.Hardening == nil || tested[check.Path] {
+			continue
+		}
+		ret = append(ret, types.TestCommand{
+			Args: []string{check.Path, "--version"},
+		})
+	}
+	return ret, nil
+}
+
+// smokeTestRunner runs the smoke tests of a single recipe.
+type smokeTestRunner struct {
+	outDir  string
+	environ []string
+
+	// Whether to run each test in a sandbox whose root only contains the
+	// command being run and these files, relative to outDir.
+	emptyRoot bool
+	dataFiles []string
+
+	// Test output is written to the log for the current phase.
+	logs *recipeLog
+}
+
+// Runs a single smoke test in the output directory.
+func (r *smokeTestRunner) run(test types.TestCommand) error {
+	if len(test.Args) == 0 {
+		return fmt.Errorf("empty test command")
+	}
+
+	args := make([]string, len(test.Args))
+	for i, arg := range test.Args {
+		args[i] = strings.Replace(arg, "${out}", r.outDir, -1)
+	}
+
+	// The output is captured so that it can be checked, and then logged.
+	var out bytes.Buffer
+	cmd := exec.Command(filepath.Join(r.outDir, filepath.FromSlash(args[0])), args[1:]...)
+	cmd.Dir = r.outDir
+	cmd.Env = r.environ
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	var err error
+	if r.emptyRoot {
+		mounts := &sandbox.Mounts{ReadOnly: []string{cmd.Path}}
+		for _, f := range r.dataFiles {
+			mounts.ReadOnly = append(mounts.ReadOnly,
+				filepath.Join(r.outDir, filepath.FromSlash(f)))
+		}
+		err = r.logs.RunIn(cmd, mounts)
+	} else {
+		err = r.logs.Run(cmd)
+	}
+	r.logs.Printf("%s", out.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if test.Output != "" && !strings.Contains(out.String(), test.Output) {
+		err = fmt.Errorf("output does not contain %q", test.Output)
+		r.logs.Printf("==> %s\n", err)
+		return err
+	}
+	return nil
+}
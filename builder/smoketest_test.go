@@ -0,0 +1,150 @@
+package builder
+
+import (
+	stdcontext "context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrew-d/sbuild/env"
+	"github.com/andrew-d/sbuild/sandbox"
+	"github.com/andrew-d/sbuild/types"
+)
+
+func TestMain(m *testing.M) {
+	// Tests in an empty root re-run the test binary as the sandbox's init
+	// process.
+	sandbox.Main()
+	os.Exit(m.Run())
+}
+
+// Creates an output directory containing a shell script, and a log for the
+// test phase.
+func setupSmokeTest(t *testing.T) (string, *recipeLog, func()) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+
+	outDir := filepath.Join(dir, "out")
+	require.NoError(t, os.MkdirAll(filepath.Join(outDir, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(outDir, "bin", "greet"),
+		[]byte("#!/bin/sh\necho \"hello $1 from $PWD\"\nexit $2\n"),
+		0755,
+	))
+
+	logs := newRecipeLog(filepath.Join(dir, "logs"), env.Empty(), nil)
+	require.NoError(t, logs.Begin(stdcontext.Background(), phaseTest))
+	return outDir, logs, func() {
+		logs.End()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRunSmokeTest(t *testing.T) {
+	outDir, logs, cleanup := setupSmokeTest(t)
+	defer cleanup()
+
+	runner := &smokeTestRunner{outDir: outDir, logs: logs}
+	run := func(args []string, output string) error {
+		return runner.run(types.TestCommand{Args: args, Output: output})
+	}
+
+	assert.NoError(t, run([]string{"bin/greet", "world", "0"}, ""))
+	assert.NoError(t, run([]string{"bin/greet", "${out}", "0"}, "hello "+outDir+" from "+outDir))
+	assert.Error(t, run([]string{"bin/greet", "world", "1"}, ""))
+	assert.EqualError(t, run([]string{"bin/greet", "world", "0"}, "goodbye"),
+		`output does not contain "goodbye"`)
+	assert.Error(t, run([]string{"bin/missing"}, ""))
+	assert.Error(t, run(nil, ""))
+	require.NoError(t, logs.End())
+
+	data, err := ioutil.ReadFile(logs.Path(phaseTest))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "hello world from "+outDir+"\n")
+	assert.Contains(t, string(data), `==> output does not contain "goodbye"`)
+}
+
+func TestRunSmokeTestEmptyRoot(t *testing.T) {
+	if !sandbox.Supported {
+		t.Skip("sandboxing is not supported here")
+	}
+	gcc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Skip("gcc is not installed")
+	}
+
+	// Check that we can create sandboxes at all, so that failures below are
+	// real ones.
+	cmd := exec.Command("true")
+	cmd.Dir = "/"
+	cmd.Env = []string{"PATH=/usr/bin:/bin"}
+	sandboxed, err := sandbox.Command(cmd, &sandbox.Mounts{ReadOnly: sandbox.DefaultPaths()})
+	require.NoError(t, err)
+	if out, err := sandboxed.CombinedOutput(); err != nil {
+		t.Skipf("cannot create a sandbox here: %s: %s", err, out)
+	}
+
+	outDir, logs, cleanup := setupSmokeTest(t)
+	defer cleanup()
+
+	// A static binary that only succeeds if its data file exists and
+	// /etc/passwd doesn't.
+	src := filepath.Join(outDir, "probe.c")
+	require.NoError(t, ioutil.WriteFile(src, []byte(`
+#include <unistd.h>
+int main(void) {
+	if (access("data.txt", R_OK) != 0) return 1;
+	if (access("/etc/passwd", F_OK) == 0) return 2;
+	return 0;
+}
+`), 0644))
+	if out, err := exec.Command(gcc, "-static", "-o",
+		filepath.Join(outDir, "probe"), src).CombinedOutput(); err != nil {
+		t.Skipf("cannot build a static binary here: %s: %s", err, out)
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outDir, "data.txt"), []byte("hi"), 0644))
+
+	runner := &smokeTestRunner{
+		outDir:    outDir,
+		environ:   []string{"PATH=/nonexistent"},
+		emptyRoot: true,
+		dataFiles: []string{"data.txt"},
+		logs:      logs,
+	}
+	probe := types.TestCommand{Args: []string{"probe"}}
+	if err := runner.run(probe); err != nil {
+		data, _ := ioutil.ReadFile(logs.Path(phaseTest))
+		require.NoError(t, err, "%s", data)
+	}
+
+	// Scripts need a shell, which isn't there.
+	assert.Error(t, runner.run(types.TestCommand{Args: []string{"bin/greet", "world", "0"}}))
+
+	// Neither is the data file, unless it's declared.
+	runner.dataFiles = nil
+	assert.Error(t, runner.run(probe))
+}
+
+func TestProbeTests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+	writeStaticELF(t, filepath.Join(dir, "bin", "foo"))
+	writeStaticELF(t, filepath.Join(dir, "bar"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644))
+
+	probes, err := probeTests(dir, "amd64", []types.TestCommand{
+		{Args: []string{"./bar", "-h"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []types.TestCommand{
+		{Args: []string{"bin/foo", "--version"}},
+	}, probes)
+}
@@ -0,0 +1,56 @@
+package builder
+
+import (
+	stdcontext "context"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/andrew-d/sbuild/config"
+)
+
+// TargetResult is the outcome of building for a single target.
+type TargetResult struct {
+	Target   config.Target
+	Duration time.Duration
+
+	// The error that the build failed with, or nil if it succeeded.
+	Err error
+}
+
+// BuildTargets runs a build of the given recipes for each target in turn.  Each
+// target is built in its own build and output directory (see
+// config.BuildConfig.ForTarget), but all targets share a source cache.  A
+// failure in one target does not stop the others from being built, but
+// cancelling runCtx does.
+func BuildTargets(runCtx stdcontext.Context, recipes []string, base *config.BuildConfig, targets []config.Target) []*TargetResult {
+	results := make([]*TargetResult, 0, len(targets))
+
+	for _, target := range targets {
+		if err := runCtx.Err(); err != nil {
+			results = append(results, &TargetResult{Target: target, Err: err})
+			continue
+		}
+
+		log.WithField("target", target).Info("Building target")
+
+		start := time.Now()
+		err := Build(runCtx, recipes, base.ForTarget(target))
+		result := &TargetResult{
+			Target:   target,
+			Duration: time.Since(start),
+			Err:      err,
+		}
+
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"target": target,
+				"err":    err,
+			}).Error("Target failed")
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
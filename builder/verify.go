@@ -0,0 +1,190 @@
+package builder
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The ELF machine and class of the binaries for each architecture.
+var elfArches = map[string]struct {
+	machine elf.Machine
+	class   elf.Class
+}{
+	"386":   {elf.EM_386, elf.ELFCLASS32},
+	"amd64": {elf.EM_X86_64, elf.ELFCLASS64},
+	"arm":   {elf.EM_ARM, elf.ELFCLASS32},
+	"arm64": {elf.EM_AARCH64, elf.ELFCLASS64},
+}
+
+// ELFCheck is the result of inspecting a single ELF file in a recipe's
+// output directory.
+type ELFCheck struct {
+	// Path relative to the recipe's output directory.
+	Path string `json:"path"`
+
+	Type    string `json:"type"`
+	Class   string `json:"class"`
+	Machine string `json:"machine"`
+
+	// The program interpreter (i.e. dynamic linker) and shared libraries
+	// that the file requires, which static binaries don't have.
+	Interpreter string   `json:"interpreter,omitempty"`
+	Needed      []string `json:"needed,omitempty"`
+
+	// For executables, which protections took effect.
+	Hardening *HardeningCheck `json:"hardening,omitempty"`
+
+	// Reasons that the file is not a valid output.  Empty if it is.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Inspects the outputs of the given recipe, recording the results in the log
+// for the verify phase and the report.  Fails if any output is invalid.
+func (ctx *context) verify(name, outDir string, logs *recipeLog) error {
+	checks, err := verifyOutputs(outDir, ctx.config.Arch)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"recipe": name,
+			"err":    err,
+		}).Error("Could not inspect outputs")
+		return err
+	}
+	ctx.report.Verify(name, checks)
+
+	var bad []string
+	if err := logs.Begin(ctx.runCtx, phaseVerify); err != nil {
+		return err
+	}
+	for _, check := range checks {
+		logs.Printf("%s: %s %s %s\n", check.Path, check.Type, check.Class, check.Machine)
+		if check.Hardening != nil {
+			logs.Printf("    %s\n", check.Hardening)
+		}
+		for _, problem := range check.Problems {
+			logs.Printf("    %s\n", problem)
+		}
+		if len(check.Problems) > 0 {
+			bad = append(bad, check.Path)
+		}
+	}
+	logs.End()
+
+	if len(bad) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("outputs failed verification: %s", strings.Join(bad, ", "))
+	log.WithFields(logrus.Fields{
+		"recipe": name,
+		"log":    logs.Path(phaseVerify),
+		"err":    err,
+	}).Error("Phase failed")
+	return &PhaseError{
+		Recipe:  name,
+		Phase:   string(phaseVerify),
+		LogPath: logs.Path(phaseVerify),
+		Err:     err,
+	}
+}
+
+// Inspects every ELF file in the given output directory, checking that
+// executables are static and that every file was built for the given
+// architecture.  Files that aren't ELF files are skipped.
+func verifyOutputs(dir, arch string) ([]*ELFCheck, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ret := []*ELFCheck{}
+	for _, path := range paths {
+		check, err := verifyFile(path, arch)
+		if err != nil {
+			return nil, err
+		}
+		if check == nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		check.Path = filepath.ToSlash(rel)
+		ret = append(ret, check)
+	}
+	return ret, nil
+}
+
+// Inspects a single file, returning nil if it's not an ELF file.
+func verifyFile(path, arch string) (*ELFCheck, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		if _, ok := err.(*elf.FormatError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	check := &ELFCheck{
+		Type:    f.Type.String(),
+		Class:   f.Class.String(),
+		Machine: f.Machine.String(),
+	}
+
+	if expected, ok := elfArches[arch]; ok {
+		if f.Machine != expected.machine || f.Class != expected.class {
+			check.Problems = append(check.Problems, fmt.Sprintf(
+				"built for %s (%s), not %s", f.Machine, f.Class, arch))
+		}
+	}
+
+	// Only executables (which includes static-pie ones) have to be static.
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return check, nil
+	}
+	check.Hardening = checkHardeningELF(f)
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return nil, err
+		}
+		check.Interpreter = strings.TrimRight(string(data), "\x00")
+		check.Problems = append(check.Problems,
+			"has a program interpreter: "+check.Interpreter)
+	}
+
+	needed, err := f.DynString(elf.DT_NEEDED)
+	if err != nil {
+		return nil, err
+	}
+	if len(needed) > 0 {
+		check.Needed = needed
+		check.Problems = append(check.Problems,
+			"needs shared libraries: "+strings.Join(needed, ", "))
+	}
+
+	return check, nil
+}
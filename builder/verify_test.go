@@ -0,0 +1,72 @@
+package builder
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Writes a minimal static x86-64 executable, which only has an ELF header.
+func writeStaticELF(t *testing.T, path string) {
+	hdr := elf.Header64{
+		Type:    uint16(elf.ET_EXEC),
+		Machine: uint16(elf.EM_X86_64),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  64,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &hdr))
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0755))
+}
+
+func TestVerifyOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+	writeStaticELF(t, filepath.Join(dir, "bin", "foo"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644))
+
+	checks, err := verifyOutputs(dir, "amd64")
+	require.NoError(t, err)
+	assert.Equal(t, []*ELFCheck{{
+		Path:    "bin/foo",
+		Type:    "ET_EXEC",
+		Class:   "ELFCLASS64",
+		Machine: "EM_X86_64",
+		Hardening: &HardeningCheck{
+			Canary:  CheckUnknown,
+			Fortify: CheckUnknown,
+			RELRO:   "none",
+		},
+	}}, checks)
+
+	checks, err = verifyOutputs(dir, "arm")
+	require.NoError(t, err)
+	require.Len(t, checks, 1)
+	assert.Equal(t, []string{"built for EM_X86_64 (ELFCLASS64), not arm"}, checks[0].Problems)
+}
+
+func TestVerifyDynamic(t *testing.T) {
+	// The host's shell is almost certainly dynamically linked.
+	check, err := verifyFile("/bin/sh", "")
+	if err != nil || check == nil || check.Interpreter == "" {
+		t.Skip("no dynamically-linked ELF shell on this host")
+	}
+
+	assert.NotEmpty(t, check.Needed)
+	assert.Len(t, check.Problems, 2)
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	flag "github.com/ogier/pflag"
@@ -9,6 +16,8 @@ import (
 	"github.com/andrew-d/sbuild/builder"
 	"github.com/andrew-d/sbuild/config"
 	"github.com/andrew-d/sbuild/logmgr"
+	"github.com/andrew-d/sbuild/sandbox"
+	"github.com/andrew-d/sbuild/util"
 
 	_ "github.com/andrew-d/sbuild/recipes"
 )
@@ -16,23 +25,95 @@ import (
 var (
 	log = logmgr.NewLogger("main")
 
-	flagPlatform string
-	flagArch     string
-	flagBuildDir string
-	flagVerbose  bool
+	flagPlatform      string
+	flagArch          string
+	flagTarget        string
+	flagBuildDir      string
+	flagJobs          int
+	flagResume        bool
+	flagFrom          string
+	flagOnly          string
+	flagDryRun        bool
+	flagRecipeTimeout time.Duration
+	flagPhaseTimeout  time.Duration
+	flagFormat        string
+	flagVerbose       bool
+	flagHardening     string
+	flagReproducible  bool
+	flagHermetic      bool
+	flagSandbox       bool
+	flagSandboxAllow  string
+	flagCheck         bool
+	flagEmptyRoot     bool
+	flagRewriteURL    string
+	flagOffline       bool
 )
 
+// Subcommands, which are given all arguments after the command name.
+var commands = map[string]func([]string) error{
+	"graph": printGraph,
+	"rdeps": printReverseDeps,
+	"why":   printWhy,
+	"repro": checkRepro,
+	"fetch": fetchSources,
+}
+
 func init() {
 	flag.StringVarP(&flagPlatform, "platform", "p", "linux",
 		"the platform to build for")
 	flag.StringVarP(&flagArch, "arch", "a", "amd64",
 		"the architecture to build for")
+	flag.StringVarP(&flagTarget, "target", "t", "",
+		"comma-separated platform/arch targets to build for (overrides --platform and --arch)")
 	flag.StringVar(&flagBuildDir, "build-dir", "/tmp/sbuild",
 		"the directory to use as a build directory")
-	flag.BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+	flag.IntVarP(&flagJobs, "jobs", "j", 1,
+		"the number of recipes to build in parallel")
+	flag.BoolVar(&flagResume, "resume", false,
+		"resume the previous build, skipping any steps it completed")
+	flag.StringVar(&flagFrom, "from", "",
+		"comma-separated recipes to rebuild, along with everything that depends on them")
+	flag.StringVar(&flagOnly, "only", "",
+		"comma-separated recipes to rebuild, reusing previous builds of everything else")
+	flag.BoolVarP(&flagDryRun, "dry-run", "n", false,
+		"print the build plan without building anything")
+	flag.DurationVar(&flagRecipeTimeout, "recipe-timeout", 0,
+		"stop building a recipe if it takes longer than this (0 means no limit)")
+	flag.DurationVar(&flagPhaseTimeout, "phase-timeout", 0,
+		"stop building a recipe if one of its phases takes longer than this (0 means no limit)")
+	flag.StringVar(&flagFormat, "format", "",
+		"the output format for --dry-run, repro and fetch (text or json) or graph (dot, json or mermaid)")
+	flag.BoolVarP(&flagVerbose, "verbose", "v", false,
+		"be verbose, and print the output of all build commands")
+	flag.StringVar(&flagHardening, "harden", "",
+		"harden binaries: basic (stack protector, fortify, RELRO, NX stack) or pie (also static-pie)")
+	flag.BoolVar(&flagReproducible, "reproducible", false,
+		"make builds reproducible, so that they produce identical outputs anywhere")
+	flag.BoolVar(&flagHermetic, "hermetic", false,
+		"build with a minimal environment instead of inheriting sbuild's")
+	flag.BoolVar(&flagSandbox, "sandbox", false,
+		"run recipe commands in a sandbox without network access or most of the host filesystem (Linux only)")
+	flag.StringVar(&flagSandboxAllow, "sandbox-allow", "",
+		"comma-separated extra host paths to make visible (read-only) in the sandbox")
+	flag.BoolVar(&flagCheck, "check", false,
+		"also run recipes' upstream test suites (e.g. make check) when the target matches the host")
+	flag.BoolVar(&flagEmptyRoot, "empty-root", false,
+		"run tests in an empty root filesystem containing only the binary and its data files (Linux only)")
+	flag.StringVar(&flagRewriteURL, "rewrite-url", "",
+		"comma-separated from->to (or from=to) rules that replace the start of source URLs, tried before the original URLs")
+	flag.BoolVar(&flagOffline, "offline", false,
+		"never download sources, and fail before building if any needed source isn't cached")
 }
 
+// The number of lines to print from the log of a failed phase.
+const failureLogLines = 20
+
 func main() {
+	// This process might be the init process of a build sandbox.
+	sandbox.Main()
+
+	flag.Parse()
+
 	logmgr.SetOutput(os.Stderr)
 	if flagVerbose {
 		logmgr.SetLevel(logrus.DebugLevel)
@@ -40,26 +121,450 @@ func main() {
 		logmgr.SetLevel(logrus.InfoLevel)
 	}
 
-	flag.Parse()
-	conf := &config.BuildConfig{
+	// Subcommands.
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.WithField("err", err).Errorf("Error running %s", flag.Arg(0))
+			os.Exit(1)
+		}
+		return
+	}
+
+	conf, err := buildConfig(flag.Arg(0))
+	if err != nil {
+		log.WithField("err", err).Error("Invalid configuration")
+		os.Exit(1)
+	}
+	recipes := expandRecipes(flag.Args()[1:])
+	targets, err := buildTargets()
+	if err != nil {
+		log.WithField("err", err).Error("Invalid target")
+		os.Exit(1)
+	}
+
+	if flagDryRun {
+		if err := printPlan(recipes, conf, targets); err != nil {
+			log.WithField("err", err).Error("Error creating build plan")
+			os.Exit(1)
+		}
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"recipes": recipes,
+		"targets": targets,
+	}).Info("Starting build")
+	results := builder.BuildTargets(interruptContext(), recipes, conf, targets)
+
+	// Print a summary of all targets.
+	failed := false
+	fmt.Println("Build summary:")
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "FAILED: " + result.Err.Error()
+			failed = true
+		}
+
+		fmt.Printf("  %-16s %-8s %s\n",
+			result.Target, result.Duration.Round(time.Second), status)
+	}
+
+	// Show the end of the log for any phase that failed.
+	for _, result := range results {
+		if perr, ok := result.Err.(*builder.PhaseError); ok {
+			printFailureLog(result.Target, perr)
+		}
+	}
+
+	if failed {
+		log.Error("Error building")
+		os.Exit(1)
+	}
+	log.Info("Successfully built")
+}
+
+// Returns a context that is cancelled when we receive SIGINT or SIGTERM, so
+// that the build can stop and clean up after itself.  Since every command
+// runs in its own process group, the terminal's signals don't reach them, so
+// we keep handling signals until we exit: a second signal kills every running
+// command's process group at once, and only then exits.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.WithField("signal", sig).Warn("Interrupted, stopping build")
+		cancel()
+
+		sig = <-signals
+		log.WithField("signal", sig).Warn("Interrupted again, killing all commands")
+		util.KillAll()
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+// Returns the build configuration given by our flags, which builds into the
+// given output directory.
+func buildConfig(outputDir string) (*config.BuildConfig, error) {
+	rewrites, err := config.ParseRewrites(flagRewriteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config.BuildConfig{
 		BuildDir:  flagBuildDir,
-		OutputDir: flag.Arg(0),
+		OutputDir: outputDir,
 		Platform:  flagPlatform,
 		Arch:      flagArch,
-	}
+		Jobs:      flagJobs,
+		Resume:    flagResume,
+		From:      splitList(flagFrom),
+		Only:      splitList(flagOnly),
+		Status:    os.Stdout,
+		Verbose:   flagVerbose,
+		Hermetic:  flagHermetic,
+		Sandbox:   flagSandbox,
+		Hardening: flagHardening,
+		Check:     flagCheck,
+		Offline:   flagOffline,
+		EmptyRoot: flagEmptyRoot,
+
+		Reproducible:  flagReproducible,
+		RecipeTimeout: flagRecipeTimeout,
+		PhaseTimeout:  flagPhaseTimeout,
+		SandboxPaths:  splitList(flagSandboxAllow),
+		Rewrites:      rewrites,
+	}, nil
+}
 
-	recipes := flag.Args()[1:]
+// Returns the targets given by our flags.
+func buildTargets() ([]config.Target, error) {
+	if flagTarget != "" {
+		return config.ParseTargets(flagTarget)
+	}
+	return []config.Target{{Platform: flagPlatform, Arch: flagArch}}, nil
+}
 
-	// Special case - passing a single 'all' means build all binaries.
+// Special case - passing a single 'all' means build all binaries.
+func expandRecipes(recipes []string) []string {
 	if len(recipes) == 1 && recipes[0] == "all" {
+		return builder.AllBinaries()
+	}
+	return recipes
+}
+
+// Builds the given recipes twice for every target, and reports any outputs
+// that differ.
+func checkRepro(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: sbuild repro <recipes...|all>")
+	}
+	recipes := expandRecipes(args)
+
+	targets, err := buildTargets()
+	if err != nil {
+		return err
+	}
+
+	// The builds' outputs are written inside their build directories.
+	conf, err := buildConfig("")
+	if err != nil {
+		return err
+	}
+	runCtx := interruptContext()
+
+	var reports []*builder.ReproReport
+	for _, target := range targets {
+		report, err := builder.CheckReproducible(runCtx, recipes, conf.ForTarget(target))
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+	}
+
+	switch flagFormat {
+	case "json":
+		data, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			return err
+		}
+
+	case "text", "":
+		for _, report := range reports {
+			fmt.Printf("%s/%s: %d files compared, %d differ\n",
+				report.Platform, report.Arch, report.Files, len(report.Differences))
+			for _, diff := range report.Differences {
+				fmt.Printf("  %s\n", diff)
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown output format: %s", flagFormat)
+	}
+
+	for _, report := range reports {
+		if !report.Reproducible() {
+			return fmt.Errorf("outputs are not reproducible")
+		}
+	}
+	return nil
+}
+
+// Downloads and verifies the sources of the given recipes for every target,
+// without building them.
+func fetchSources(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: sbuild fetch <recipes...|all>")
+	}
+	recipes := expandRecipes(args)
+
+	targets, err := buildTargets()
+	if err != nil {
+		return err
+	}
+	conf, err := buildConfig("")
+	if err != nil {
+		return err
+	}
+
+	results, err := builder.FetchSources(interruptContext(), recipes, conf, targets)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+
+	switch flagFormat {
+	case "json":
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			return err
+		}
+
+	case "text", "":
+		for _, result := range results {
+			fmt.Printf("  %-10s %s: %s\n", result.Status, result.Recipe, result.Filename)
+			if result.Error != "" {
+				fmt.Printf("             %s\n", result.Error)
+			}
+		}
+		fmt.Printf("%d sources: %d downloaded, %d already cached, %d failed\n",
+			len(results),
+			counts[builder.FetchDownloaded],
+			counts[builder.FetchCached],
+			counts[builder.FetchFailed])
+
+	default:
+		return fmt.Errorf("unknown output format: %s", flagFormat)
+	}
+
+	if n := counts[builder.FetchFailed]; n > 0 {
+		return fmt.Errorf("could not fetch %d sources", n)
+	}
+	return nil
+}
+
+func printFailureLog(target config.Target, perr *builder.PhaseError) {
+	fmt.Printf("\n%s: %s of %s failed, last lines of %s:\n",
+		target, perr.Phase, perr.Recipe, perr.LogPath)
+
+	lines, err := builder.LogTail(perr.LogPath, failureLogLines)
+	if err != nil {
+		fmt.Printf("  (could not read log: %s)\n", err)
+		return
+	}
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+func printPlan(recipes []string, conf *config.BuildConfig, targets []config.Target) error {
+	var plans []*builder.Plan
+	for _, target := range targets {
+		plan, err := builder.MakePlan(recipes, conf.ForTarget(target))
+		if err != nil {
+			return err
+		}
+		plans = append(plans, plan)
+	}
+
+	switch flagFormat {
+	case "json":
+		// A single target is printed as a single plan, for convenience.
+		var v interface{} = plans
+		if len(plans) == 1 {
+			v = plans[0]
+		}
+
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+
+	case "text", "":
+		for i, plan := range plans {
+			if i > 0 {
+				fmt.Println()
+			}
+			if err := plan.WriteText(os.Stdout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown output format: %s", flagFormat)
+}
+
+func printGraph(recipes []string) error {
+	switch {
+	case len(recipes) == 0:
+		recipes = builder.AllRecipes()
+	case len(recipes) == 1 && recipes[0] == "all":
 		recipes = builder.AllBinaries()
 	}
 
-	log.WithField("recipes", recipes).Info("Starting build")
-	err := builder.Build(recipes, conf)
+	targets, err := buildTargets()
 	if err != nil {
-		log.WithField("err", err).Error("Error building")
-	} else {
-		log.Info("Successfully built")
+		return err
+	}
+
+	var graphs []*builder.Graph
+	for _, target := range targets {
+		graph, err := builder.DependencyGraph(recipes, target.Platform, target.Arch)
+		if err != nil {
+			return err
+		}
+		graphs = append(graphs, graph)
+	}
+
+	var write func(*builder.Graph) error
+	switch flagFormat {
+	case "json":
+		// A single target is printed as a single graph, for convenience.
+		var v interface{} = graphs
+		if len(graphs) == 1 {
+			v = graphs[0]
+		}
+
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+
+	case "mermaid":
+		write = func(g *builder.Graph) error { return g.WriteMermaid(os.Stdout) }
+
+	case "dot", "":
+		write = func(g *builder.Graph) error { return g.WriteDOT(os.Stdout) }
+
+	default:
+		return fmt.Errorf("unknown output format: %s", flagFormat)
+	}
+
+	for i, graph := range graphs {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := write(graph); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prints the heading for the results for the given target, if there are
+// several targets.  Returns the indent for the results.
+func printTargetHeading(i int, targets []config.Target) string {
+	if len(targets) == 1 {
+		return ""
+	}
+	if i > 0 {
+		fmt.Println()
+	}
+	fmt.Printf("%s:\n", targets[i])
+	return "  "
+}
+
+func printReverseDeps(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: sbuild rdeps <recipe>")
+	}
+
+	targets, err := buildTargets()
+	if err != nil {
+		return err
+	}
+
+	for i, target := range targets {
+		names, err := builder.ReverseDependencies(args[0], target.Platform, target.Arch)
+		if err != nil {
+			return err
+		}
+
+		indent := printTargetHeading(i, targets)
+		for _, name := range names {
+			fmt.Println(indent + name)
+		}
+	}
+	return nil
+}
+
+func printWhy(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: sbuild why <recipe> <dependency>")
+	}
+
+	targets, err := buildTargets()
+	if err != nil {
+		return err
+	}
+
+	for i, target := range targets {
+		paths, err := builder.DependencyPaths(args[0], args[1], target.Platform, target.Arch)
+		if err != nil {
+			return err
+		}
+
+		indent := printTargetHeading(i, targets)
+		if len(paths) == 0 {
+			fmt.Printf("%s%s does not depend on %s on %s\n",
+				indent, args[0], args[1], target)
+			continue
+		}
+
+		for _, path := range paths {
+			fmt.Println(indent + strings.Join(path, " -> "))
+		}
+	}
+	return nil
+}
+
+// Splits a comma-separated list, ignoring empty entries.
+func splitList(s string) []string {
+	var ret []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
 	}
+	return ret
 }
@@ -1,5 +1,13 @@
 package config
 
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
 // Information that must be provided in order to run a build.
 type BuildConfig struct {
 	// The working directory for the build.
@@ -8,9 +16,231 @@ type BuildConfig struct {
 	// The output directory for build products.
 	OutputDir string
 
+	// The directory that downloaded sources are cached in.  If empty, the
+	// '.cache' directory inside BuildDir is used.
+	CacheDir string
+
+	// The directory that build logs are written to, in a subdirectory for
+	// each target.  If empty, the 'logs' directory inside BuildDir is used.
+	LogDir string
+
 	// The operating system to build for.
 	Platform string
 
 	// The architecture to build for.
 	Arch string
+
+	// The maximum number of recipes to build at once.  Values less than 1 are
+	// treated as 1.
+	Jobs int
+
+	// Whether to resume a previous build, skipping any steps that it
+	// completed.
+	Resume bool
+
+	// If set, only these recipes and the recipes that depend on them are
+	// built.  All other recipes reuse the results recorded by a previous
+	// build.
+	From []string
+
+	// If set, only these recipes are built.  All other recipes reuse the
+	// results recorded by a previous build.
+	Only []string
+
+	// If non-zero, the maximum time that building a single recipe, or a
+	// single phase of a recipe (e.g. Build), may take before it is stopped.
+	RecipeTimeout time.Duration
+	PhaseTimeout  time.Duration
+
+	// If set, a short status line is written here as each recipe finishes.
+	Status io.Writer
+
+	// Whether to also write the output of every command run by a recipe to
+	// Status, in addition to the recipe's log files.
+	Verbose bool
+
+	// How much to harden the binaries that are built, as one of the Hardening*
+	// constants.
+	Hardening string
+
+	// Whether to make builds reproducible, i.e. produce bit-for-bit identical
+	// outputs no matter where, when or on which machine they're built.
+	Reproducible bool
+
+	// Whether to build in a hermetic environment, which only contains PATH
+	// (the toolchain and host tools), HOME (an empty directory), LC_ALL=C,
+	// TZ=UTC and the host variables that recipes ask for, instead of
+	// sbuild's own environment.
+	Hermetic bool
+
+	// Variables that are set in the environment that every recipe's
+	// environment is based on, on top of the host's (or, if the build is
+	// hermetic, the allowlisted variables).
+	ExtraEnv map[string]string
+
+	// Whether to run the commands of each recipe's Prepare, Build and
+	// Finalize phases in a sandbox, without network access and with only
+	// the recipe's own directories, its dependencies' outputs, the toolchain
+	// and an allowlisted set of host paths visible.
+	Sandbox bool
+
+	// Extra host paths that are visible (read-only) inside the sandbox.
+	SandboxPaths []string
+
+	// Whether to also run the upstream test suites (e.g. `make check`) of
+	// recipes that have one, when the target matches the host.  Recipes'
+	// smoke tests are always run in that case.
+	Check bool
+
+	// Rules that rewrite the URLs of sources, e.g. to download them from a
+	// local mirror.  Rewritten URLs are tried before the original ones.
+	Rewrites []URLRewrite
+
+	// Whether to build without network access to download sources.  Every
+	// source that the build needs must already be in the cache, which is
+	// checked before anything is built.
+	Offline bool
+
+	// Whether to run each test in an empty root filesystem, which only
+	// contains the binary being tested and its recipe's data files, so that
+	// binaries can't depend on anything from the host.  Executables without
+	// a test are run with `--version`.  Requires sandbox support.
+	EmptyRoot bool
+}
+
+// Hardening levels for BuildConfig.Hardening.
+const (
+	// No hardening beyond what the toolchain does by default.
+	HardeningNone = ""
+
+	// Stack protector, _FORTIFY_SOURCE, full RELRO and a non-executable
+	// stack.
+	HardeningBasic = "basic"
+
+	// Everything in HardeningBasic, and static position-independent
+	// executables (for ASLR).
+	HardeningPIE = "pie"
+)
+
+// SourceCacheDir returns the directory that downloaded sources are cached in.
+func (c *BuildConfig) SourceCacheDir() string {
+	if c.CacheDir != "" {
+		return c.CacheDir
+	}
+	return filepath.Join(c.BuildDir, ".cache")
+}
+
+// LogsDir returns the directory that build logs for this configuration's
+// target are written to.
+func (c *BuildConfig) LogsDir() string {
+	return filepath.Join(c.logRoot(), Target{c.Platform, c.Arch}.DirName())
+}
+
+func (c *BuildConfig) logRoot() string {
+	if c.LogDir != "" {
+		return c.LogDir
+	}
+	return filepath.Join(c.BuildDir, "logs")
+}
+
+// ForTarget returns a copy of this configuration that builds for the given
+// target.  The copy uses a build and output directory specific to the target,
+// but shares the source cache and log directory with this configuration.
+func (c *BuildConfig) ForTarget(t Target) *BuildConfig {
+	ret := *c
+	ret.Platform = t.Platform
+	ret.Arch = t.Arch
+	ret.BuildDir = filepath.Join(c.BuildDir, t.DirName())
+	ret.OutputDir = filepath.Join(c.OutputDir, t.DirName())
+	ret.CacheDir = c.SourceCacheDir()
+	ret.LogDir = c.logRoot()
+	return &ret
+}
+
+// Target is a single platform and architecture to build for.
+type Target struct {
+	Platform string
+	Arch     string
+}
+
+// String returns the target in "platform/arch" form.
+func (t Target) String() string {
+	return t.Platform + "/" + t.Arch
+}
+
+// DirName returns the name of the directories that hold this target's build
+// and output trees.
+func (t Target) DirName() string {
+	return t.Platform + "-" + t.Arch
+}
+
+// ParseTargets parses a comma-separated list of targets in "platform/arch"
+// form.  Each target may only be given once.
+func ParseTargets(s string) ([]Target, error) {
+	var ret []Target
+	seen := make(map[Target]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("config: invalid target %q (expected platform/arch)", item)
+		}
+
+		target := Target{Platform: parts[0], Arch: parts[1]}
+		if seen[target] {
+			return nil, fmt.Errorf("config: target %q given more than once", item)
+		}
+		seen[target] = true
+
+		ret = append(ret, target)
+	}
+
+	return ret, nil
+}
+
+// URLRewrite replaces the start of a URL, e.g. "https://ftp.gnu.org/gnu/" with
+// "http://mirror.internal/gnu/".
+type URLRewrite struct {
+	From string
+	To   string
+}
+
+// Rewrite returns the rewritten URL, and whether the rule applies to it.
+func (r URLRewrite) Rewrite(url string) (string, bool) {
+	if !strings.HasPrefix(url, r.From) {
+		return url, false
+	}
+	return r.To + strings.TrimPrefix(url, r.From), true
+}
+
+// ParseRewrites parses a comma-separated list of URL rewrite rules in
+// "from->to" or "from=to" form.  Since URLs with a query string contain "=",
+// a rule containing "->" is always split there, and other rules are split at
+// their first "=".
+func ParseRewrites(s string) ([]URLRewrite, error) {
+	var ret []URLRewrite
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		sep := "="
+		if strings.Contains(item, "->") {
+			sep = "->"
+		}
+
+		parts := strings.SplitN(item, sep, 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("config: invalid URL rewrite %q (expected from->to or from=to)", item)
+		}
+
+		ret = append(ret, URLRewrite{From: parts[0], To: parts[1]})
+	}
+
+	return ret, nil
 }
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTargets(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected []Target
+		err      bool
+	}{
+		{in: "", expected: nil},
+		{in: "linux/amd64", expected: []Target{{"linux", "amd64"}}},
+		{in: "linux/amd64,darwin/amd64", expected: []Target{
+			{"linux", "amd64"},
+			{"darwin", "amd64"},
+		}},
+		{in: " linux/amd64 , ,darwin/amd64,", expected: []Target{
+			{"linux", "amd64"},
+			{"darwin", "amd64"},
+		}},
+		{in: "linux", err: true},
+		{in: "linux/", err: true},
+		{in: "/amd64", err: true},
+		{in: "a/b/c", err: true},
+		{in: "linux/amd64,linux/arm", expected: []Target{
+			{"linux", "amd64"},
+			{"linux", "arm"},
+		}},
+		{in: "linux/amd64,darwin/amd64,linux/amd64", err: true},
+	} {
+		targets, err := ParseTargets(tc.in)
+		if tc.err {
+			assert.Error(t, err, "parsing %q", tc.in)
+			continue
+		}
+		if assert.NoError(t, err, "parsing %q", tc.in) {
+			assert.Equal(t, tc.expected, targets, "parsing %q", tc.in)
+		}
+	}
+}
+
+func TestForTarget(t *testing.T) {
+	base := &BuildConfig{
+		BuildDir:  "/build",
+		OutputDir: "/out",
+		Platform:  "linux",
+		Arch:      "amd64",
+	}
+
+	linux := base.ForTarget(Target{"linux", "arm"})
+	darwin := base.ForTarget(Target{"darwin", "amd64"})
+
+	assert.Equal(t, "linux", linux.Platform)
+	assert.Equal(t, "arm", linux.Arch)
+	assert.Equal(t, "/build/linux-arm", linux.BuildDir)
+	assert.Equal(t, "/out/linux-arm", linux.OutputDir)
+	assert.Equal(t, "darwin", darwin.Platform)
+	assert.Equal(t, "amd64", darwin.Arch)
+	assert.Equal(t, "/build/darwin-amd64", darwin.BuildDir)
+	assert.Equal(t, "/out/darwin-amd64", darwin.OutputDir)
+
+	// The source cache and log root are shared, with logs in a directory
+	// for each target.
+	for _, conf := range []*BuildConfig{linux, darwin} {
+		assert.Equal(t, "/build/.cache", conf.SourceCacheDir())
+		assert.Equal(t, "/build/logs", conf.LogDir)
+	}
+	assert.Equal(t, "/build/logs/linux-arm", linux.LogsDir())
+	assert.Equal(t, "/build/logs/darwin-amd64", darwin.LogsDir())
+
+	// The original configuration is unchanged.
+	assert.Equal(t, "/build", base.BuildDir)
+	assert.Equal(t, "amd64", base.Arch)
+
+	// Explicit cache and log directories are kept as they are.
+	base.CacheDir = "/cache"
+	base.LogDir = "/logs"
+	conf := base.ForTarget(Target{"linux", "arm"})
+	assert.Equal(t, "/cache", conf.SourceCacheDir())
+	assert.Equal(t, "/logs/linux-arm", conf.LogsDir())
+}
+
+func TestParseRewrites(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected []URLRewrite
+		err      bool
+	}{
+		{in: "", expected: nil},
+		{in: "http://a/=http://b/", expected: []URLRewrite{{"http://a/", "http://b/"}}},
+		{in: "http://a/->http://b/", expected: []URLRewrite{{"http://a/", "http://b/"}}},
+		{in: " http://a/=http://b/ ,, http://c/->http://d/,", expected: []URLRewrite{
+			{"http://a/", "http://b/"},
+			{"http://c/", "http://d/"},
+		}},
+
+		// Query strings contain "=", so need "->".
+		{in: "http://a/get?file=->http://b/files/", expected: []URLRewrite{
+			{"http://a/get?file=", "http://b/files/"},
+		}},
+		{in: "http://a/->http://b/get?file=", expected: []URLRewrite{
+			{"http://a/", "http://b/get?file="},
+		}},
+		{in: "http://a/=http://b/get?file=", expected: []URLRewrite{
+			{"http://a/", "http://b/get?file="},
+		}},
+
+		{in: "http://a/", err: true},
+		{in: "=http://b/", err: true},
+		{in: "http://a/=", err: true},
+		{in: "http://a/->", err: true},
+		{in: "->http://b/", err: true},
+	} {
+		rewrites, err := ParseRewrites(tc.in)
+		if tc.err {
+			assert.Error(t, err, "parsing %q", tc.in)
+			continue
+		}
+		if assert.NoError(t, err, "parsing %q", tc.in) {
+			assert.Equal(t, tc.expected, rewrites, "parsing %q", tc.in)
+		}
+	}
+}
+
+func TestURLRewrite(t *testing.T) {
+	rule := URLRewrite{From: "https://ftp.gnu.org/gnu/", To: "http://mirror.internal/gnu/"}
+
+	url, ok := rule.Rewrite("https://ftp.gnu.org/gnu/tar/tar-1.28.tar.gz")
+	assert.True(t, ok)
+	assert.Equal(t, "http://mirror.internal/gnu/tar/tar-1.28.tar.gz", url)
+
+	url, ok = rule.Rewrite("https://example.com/gnu/tar.tar.gz")
+	assert.False(t, ok)
+	assert.Equal(t, "https://example.com/gnu/tar.tar.gz", url)
+}
@@ -2,6 +2,7 @@ package env
 
 import (
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -92,11 +93,18 @@ func (e *Env) MergeAppend(other *Env) *Env {
 	return &Env{vars}
 }
 
-// Returns a slice of environment variables in the standard "key=value" form.
+// Returns a slice of environment variables in the standard "key=value" form,
+// sorted by key, so that commands always see the same environment.
 func (e *Env) AsSlice() []string {
+	keys := make([]string, 0, len(e.vars))
+	for k := range e.vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	ret := make([]string, 0, len(e.vars))
-	for k, v := range e.vars {
-		ret = append(ret, k+"="+v)
+	for _, k := range keys {
+		ret = append(ret, k+"="+e.vars[k])
 	}
 	return ret
 }
@@ -89,3 +89,8 @@ func TestMergeAppend(t *testing.T) {
 	n := first.MergeAppend(second)
 	assert.Equal(t, " foo  bar ", n.Get("key"))
 }
+
+func TestAsSliceSorted(t *testing.T) {
+	env := Empty().Set("c", "3").Set("a", "1").Set("b", "2")
+	assert.Equal(t, []string{"a=1", "b=2", "c=3"}, env.AsSlice())
+}
@@ -1,7 +1,6 @@
 package recipes
 
 import (
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -31,6 +30,9 @@ func (r *AgRecipe) Info() *types.RecipeInfo {
 			"a3b61b80f96647dbe89c7e89a8fa7612545db6fa4a313c0ef8a574d01e7da5db",
 		},
 		Binary: true,
+		Tests: []types.TestCommand{
+			{Args: []string{"ag", "--version"}, Output: "ag version"},
+		},
 	}
 }
 
@@ -47,45 +49,32 @@ func (r *AgRecipe) Build(ctx *types.BuildContext) error {
 	// Run autotools
 	cmd = exec.Command("autoreconf", "-i")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run autotools")
 		return err
 	}
 
 	log.Infof("Running ./configure")
-	cmd = exec.Command(
-		"./configure",
-		"--host="+ctx.CrossPrefix,
+	args := append([]string{
+		"--host=" + ctx.CrossPrefix,
 		"--build=i686",
-		"PKG_CONFIG=/bin/true",
-	)
+	}, ctx.ConfigureFlags...)
+	cmd = exec.Command("./configure", args...)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Append("CC", ctx.StaticFlags).
 		Set("CFLAGS", "-fPIC "+ctx.StaticFlags).
-		Set("PCRE_LIBS", ctx.DependencyEnv["pcre"]["LDFLAGS"]).
-		Set("PCRE_CFLAGS", ctx.DependencyEnv["pcre"]["CFLAGS"]).
-		Set("LZMA_LIBS", ctx.DependencyEnv["lzma"]["LDFLAGS"]).
-		Set("LZMA_CFLAGS", ctx.DependencyEnv["lzma"]["CFLAGS"]).
-		Set("ZLIB_LIBS", ctx.DependencyEnv["zlib"]["LDFLAGS"]).
-		Set("ZLIB_CFLAGS", ctx.DependencyEnv["zlib"]["CFLAGS"]).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
 
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -32,7 +32,16 @@ func (r *BinutilsRecipe) Info() *types.RecipeInfo {
 		Sums: []string{
 			"cccf377168b41a52a76f46df18feb8f7285654b3c1bd69fc8265cb0fc6902f2d",
 		},
+		Mirrors: [][]string{
+			{
+				"https://ftpmirror.gnu.org/binutils/binutils-${version}.tar.gz",
+			},
+		},
 		Binary: true,
+		Tests: []types.TestCommand{
+			{Args: []string{"readelf", "-h", "${out}/readelf"}, Output: "ELF Header:"},
+			{Args: []string{"objdump", "-f", "${out}/objdump"}, Output: "file format elf"},
+		},
 	}
 }
 
@@ -65,7 +74,7 @@ func (r *BinutilsRecipe) Build(ctx *types.BuildContext) error {
 	)
 	cmd.Dir = buildDir
 	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not get configure options")
 		return err
 	}
@@ -118,6 +127,7 @@ func (r *BinutilsRecipe) Build(ctx *types.BuildContext) error {
 	*/
 
 	// 5. Actually run the configure
+	configureOpts = append(configureOpts, ctx.ConfigureFlags...)
 	log.WithField("opts", configureOpts).Info("Running ./configure")
 	cmd = exec.Command(
 		filepath.Join(unpackedDir, "configure"),
@@ -130,10 +140,8 @@ func (r *BinutilsRecipe) Build(ctx *types.BuildContext) error {
 		Set("CFLAGS", ctx.StaticFlags).
 		Set("CXXFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
@@ -152,10 +160,8 @@ func (r *BinutilsRecipe) Build(ctx *types.BuildContext) error {
 	for _, commandArr := range commands {
 		cmd = exec.Command(commandArr[0], commandArr[1:]...)
 		cmd.Dir = buildDir
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stdout
 
-		if err := cmd.Run(); err != nil {
+		if err := ctx.Run(cmd); err != nil {
 			log.WithField("err", err).Errorf("Could not run command: %s", commandArr)
 			return err
 		}
@@ -3,7 +3,6 @@ package recipes
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -33,6 +32,13 @@ func (r *FileRecipe) Info() *types.RecipeInfo {
 			"52e160662c45d8b204c583552d80e4ab389a3a641f9745a458da2f6761c9b206",
 		},
 		Binary: true,
+		Tests: []types.TestCommand{
+			{
+				Args:   []string{"file", "-m", "${out}/magic.mgc", "${out}/file"},
+				Output: "ELF",
+			},
+		},
+		DataFiles: []string{"magic.mgc"},
 	}
 }
 
@@ -67,7 +73,7 @@ func (r *FileRecipe) Prepare(ctx *types.BuildContext) error {
 		filepath.Join(srcdir, "src", "encoding.c"),
 		filepath.Join(srcdir, "src", "ascmagic.c"),
 	)
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		return err
 	}
 
@@ -83,9 +89,7 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 	// 1. Run autotools
 	cmd = exec.Command("autoreconf", "-i")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run autotools")
 		return err
 	}
@@ -97,7 +101,7 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 		"--disable-shared",
 	)
 	cmd.Dir = srcdir
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run native configure")
 		return err
 	}
@@ -106,7 +110,7 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 	log.Infof("Running native build")
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run native build")
 		return err
 	}
@@ -123,16 +127,16 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 	}
 
 	// 5. Clean up.
-	_ = exec.Command("make", "distclean").Run()
+	_ = ctx.Run(exec.Command("make", "distclean"))
 
 	// 6. Configure for cross-compiling.
 	log.Infof("Running ./configure")
-	cmd = exec.Command(
-		"./configure",
+	args := append([]string{
 		"--disable-shared",
-		"--host="+ctx.CrossPrefix,
+		"--host=" + ctx.CrossPrefix,
 		"--build=i686",
-	)
+	}, ctx.ConfigureFlags...)
+	cmd = exec.Command("./configure", args...)
 	cmd.Dir = srcdir
 	env := ctx.Env.
 		Append("CC", ctx.StaticFlags).
@@ -145,10 +149,8 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 	}
 
 	cmd.Env = env.AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
@@ -160,7 +162,7 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 		fmt.Sprintf("s|FILE_COMPILE = file${EXEEXT}|FILE_COMPILE = %s|", nativePath),
 		filepath.Join(srcdir, "magic", "Makefile"),
 	)
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not patch Makefile")
 		return err
 	}
@@ -168,10 +170,8 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 	// 8. Run native build
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -180,6 +180,18 @@ func (r *FileRecipe) Build(ctx *types.BuildContext) error {
 	return nil
 }
 
+func (r *FileRecipe) Check(ctx *types.BuildContext) error {
+	cmd := exec.Command("make", "check")
+	cmd.Dir = r.UnpackedDir(ctx)
+
+	if err := ctx.Run(cmd); err != nil {
+		log.WithField("err", err).Error("Could not run file test suite")
+		return err
+	}
+
+	return nil
+}
+
 func (r *FileRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx)
 
@@ -2,7 +2,6 @@ package libiconv
 
 import (
 	"bytes"
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -37,7 +36,15 @@ func (r *IconvRecipe) Info() *types.RecipeInfo {
 		Sums: []string{
 			"72b24ded17d687193c3366d0ebe7cde1e6b18f0df8c55438ac95be39e8a30613",
 		},
+		Mirrors: [][]string{
+			{
+				"https://ftpmirror.gnu.org/libiconv/libiconv-${version}.tar.gz",
+			},
+		},
 		Library: true,
+		Exports: types.LibraryExports{
+			Libs: []string{"iconv"},
+		},
 	}
 }
 
@@ -45,6 +52,10 @@ func (r *IconvRecipe) Dependencies(platform, arch string) []string {
 	return nil
 }
 
+func (r *IconvRecipe) Assets() map[string][]byte {
+	return templates.CollectAssets(AssetNames(), MustAsset)
+}
+
 func (r *IconvRecipe) Prepare(ctx *types.BuildContext) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
 
@@ -75,10 +86,8 @@ func (r *IconvRecipe) Prepare(ctx *types.BuildContext) error {
 		cmd := exec.Command("patch", "-p1")
 		cmd.Dir = srcdir
 		cmd.Stdin = bytes.NewBuffer(MustAsset(patch))
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 
-		if err := cmd.Run(); err != nil {
+		if err := ctx.Run(cmd); err != nil {
 			log.WithFields(logrus.Fields{
 				"patch": patch,
 				"err":   err,
@@ -95,9 +104,7 @@ func (r *IconvRecipe) Prepare(ctx *types.BuildContext) error {
 		filepath.Join(srcdir, "Makefile.in"),
 	)
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		return err
 	}
 
@@ -122,6 +129,7 @@ func (r *IconvRecipe) Build(ctx *types.BuildContext) error {
 		"--enable-extra-encodings",
 		"--host="+ctx.CrossPrefix,
 		"--build=i686",
+		"--prefix="+ctx.Prefix,
 	)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
@@ -129,20 +137,16 @@ func (r *IconvRecipe) Build(ctx *types.BuildContext) error {
 		Set("CXXFLAGS", ctx.StaticFlags).
 		Set("LDFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
 
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -153,13 +157,18 @@ func (r *IconvRecipe) Build(ctx *types.BuildContext) error {
 
 func (r *IconvRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
-	ctx.AddDependentEnvVar(
-		"CPPFLAGS",
-		"-I"+filepath.Join(srcdir, "include"),
-	)
-	ctx.AddDependentEnvVar(
-		"LDFLAGS",
-		"-L"+filepath.Join(srcdir, "lib", ".libs")+" -liconv",
-	)
+
+	// We don't build the iconv executable, so only install the library and
+	// its header.
+	for _, dir := range []string{"lib", "include"} {
+		if err := r.Install(ctx, filepath.Join(srcdir, dir)); err != nil {
+			log.WithFields(logrus.Fields{
+				"dir": dir,
+				"err": err,
+			}).Error("Could not install libiconv")
+			return err
+		}
+	}
+
 	return nil
 }
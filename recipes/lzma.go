@@ -2,7 +2,6 @@ package recipes
 
 import (
 	"fmt"
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -29,7 +28,16 @@ func (r *LzmaRecipe) Info() *types.RecipeInfo {
 		Sums: []string{
 			"cac71b31ed322a487f1da1f10dfcf47f8855f97ff2c23b92680c7ae7be58babb",
 		},
+		Mirrors: [][]string{
+			{
+				"https://tukaani.org/xz/xz-${version}.tar.gz",
+				"https://downloads.sourceforge.net/project/lzmautils/xz-${version}.tar.gz",
+			},
+		},
 		Library: true,
+		Exports: types.LibraryExports{
+			Libs: []string{"lzma"},
+		},
 	}
 }
 
@@ -47,26 +55,23 @@ func (r *LzmaRecipe) Build(ctx *types.BuildContext) error {
 		"--enable-static",
 		"--host="+ctx.CrossPrefix,
 		"--build=i686",
+		"--prefix="+ctx.Prefix,
 	)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Set("CFLAGS", ctx.StaticFlags).
 		Set("CXXFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
 
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -77,13 +82,10 @@ func (r *LzmaRecipe) Build(ctx *types.BuildContext) error {
 
 func (r *LzmaRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := filepath.Join(ctx.SourceDir, fmt.Sprintf("xz-%s", r.Info().Version))
-	ctx.AddDependentEnvVar(
-		"CPPFLAGS",
-		"-I"+filepath.Join(srcdir, "src", "liblzma", "api"),
-	)
-	ctx.AddDependentEnvVar(
-		"LDFLAGS",
-		"-L"+filepath.Join(srcdir, "src", "liblzma", ".libs")+" -llzma",
-	)
+	if err := r.Install(ctx, srcdir); err != nil {
+		log.WithField("err", err).Error("Could not install LZMA")
+		return err
+	}
+
 	return nil
 }
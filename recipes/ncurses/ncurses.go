@@ -2,9 +2,7 @@ package ncurses
 
 import (
 	"bytes"
-	"os"
 	"os/exec"
-	"path/filepath"
 
 	"github.com/Sirupsen/logrus"
 
@@ -38,6 +36,9 @@ func (r *NcursesRecipe) Info() *types.RecipeInfo {
 			"9046298fb440324c9d4135ecea7879ffed8546dd1b58e59430ea07a4633f563b",
 		},
 		Library: true,
+		Exports: types.LibraryExports{
+			Libs: []string{"ncurses"},
+		},
 	}
 }
 
@@ -45,6 +46,10 @@ func (r *NcursesRecipe) Dependencies(platform, arch string) []string {
 	return nil
 }
 
+func (r *NcursesRecipe) Assets() map[string][]byte {
+	return templates.CollectAssets(AssetNames(), MustAsset)
+}
+
 func (r *NcursesRecipe) Prepare(ctx *types.BuildContext) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
 
@@ -55,10 +60,8 @@ func (r *NcursesRecipe) Prepare(ctx *types.BuildContext) error {
 		cmd := exec.Command("patch", "-p1")
 		cmd.Dir = srcdir
 		cmd.Stdin = bytes.NewBuffer(MustAsset(patch))
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 
-		if err := cmd.Run(); err != nil {
+		if err := ctx.Run(cmd); err != nil {
 			log.WithFields(logrus.Fields{
 				"patch": patch,
 				"err":   err,
@@ -86,28 +89,26 @@ func (r *NcursesRecipe) Build(ctx *types.BuildContext) error {
 		"--with-normal",
 		"--without-debug",
 		"--without-ada",
+		"--enable-overwrite",
 		"--host="+ctx.CrossPrefix,
 		"--build=i686",
+		"--prefix="+ctx.Prefix,
 	)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Set("CFLAGS", ctx.StaticFlags).
 		Set("CXXFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
 
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -118,13 +119,13 @@ func (r *NcursesRecipe) Build(ctx *types.BuildContext) error {
 
 func (r *NcursesRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
-	ctx.AddDependentEnvVar(
-		"CPPFLAGS",
-		"-I"+srcdir,
-	)
-	ctx.AddDependentEnvVar(
-		"LDFLAGS",
-		"-L"+filepath.Join(srcdir, "lib")+" -lncurses",
-	)
+
+	// Only install the libraries and headers - the terminfo database and
+	// programs aren't needed by anything that links against ncurses.
+	if err := r.Install(ctx, srcdir, "install.libs", "install.includes"); err != nil {
+		log.WithField("err", err).Error("Could not install ncurses")
+		return err
+	}
+
 	return nil
 }
@@ -6,6 +6,8 @@ import (
 	"os/exec"
 	"path/filepath"
 
+	"github.com/Sirupsen/logrus"
+
 	"github.com/andrew-d/sbuild/builder"
 	"github.com/andrew-d/sbuild/recipes/templates"
 	"github.com/andrew-d/sbuild/types"
@@ -30,6 +32,9 @@ func (r *OpenSSLRecipe) Info() *types.RecipeInfo {
 			"671c36487785628a703374c652ad2cebea45fa920ae5681515df25d9f2c9a8c8",
 		},
 		Library: true,
+		Exports: types.LibraryExports{
+			Libs: []string{"ssl", "crypto"},
+		},
 	}
 }
 
@@ -71,6 +76,7 @@ func (r *OpenSSLRecipe) Build(ctx *types.BuildContext) error {
 		"perl",
 		"./Configure",
 		"no-shared",
+		"--prefix="+ctx.Prefix,
 		target,
 
 		// Accelerated NIST P-224 and P-256 encryption support.
@@ -81,20 +87,18 @@ func (r *OpenSSLRecipe) Build(ctx *types.BuildContext) error {
 		Set("CFLAGS", ctx.StaticFlags).
 		Set("CXXFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run Configure")
 		return err
 	}
 
-	cmd = exec.Command("make", "build_libs")
+	// Only build the libraries and their pkg-config files, since the
+	// command-line tools don't build when cross-compiling.
+	cmd = exec.Command("make", "build_libs", "libcrypto.pc", "libssl.pc", "openssl.pc")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -105,13 +109,47 @@ func (r *OpenSSLRecipe) Build(ctx *types.BuildContext) error {
 
 func (r *OpenSSLRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
-	ctx.AddDependentEnvVar(
-		"CPPFLAGS",
-		"-I"+filepath.Join(srcdir, "include"),
-	)
-	ctx.AddDependentEnvVar(
-		"LDFLAGS",
-		"-L"+srcdir+" -lcrypto -lssl",
-	)
+
+	// OpenSSL's install targets also install the command-line tools, which
+	// we haven't built, so we install the libraries by hand.  The headers in
+	// include/openssl are symlinks, which are resolved when copying.
+	usrDir := filepath.Join(ctx.StagingDir, ctx.Prefix)
+	includeDir := filepath.Join(usrDir, "include", "openssl")
+	pkgconfigDir := filepath.Join(usrDir, "lib", "pkgconfig")
+	for _, dir := range []string{includeDir, pkgconfigDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	headers, err := filepath.Glob(filepath.Join(srcdir, "include", "openssl", "*.h"))
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		target := filepath.Join(includeDir, filepath.Base(header))
+		if err := r.CopyFile(header, target, 0644); err != nil {
+			log.WithField("err", err).Error("Could not install header")
+			return err
+		}
+	}
+
+	files := map[string]string{
+		"libssl.a":     filepath.Join(usrDir, "lib"),
+		"libcrypto.a":  filepath.Join(usrDir, "lib"),
+		"libssl.pc":    pkgconfigDir,
+		"libcrypto.pc": pkgconfigDir,
+		"openssl.pc":   pkgconfigDir,
+	}
+	for name, dir := range files {
+		if err := r.CopyFile(filepath.Join(srcdir, name), filepath.Join(dir, name), 0644); err != nil {
+			log.WithFields(logrus.Fields{
+				"file": name,
+				"err":  err,
+			}).Error("Could not install file")
+			return err
+		}
+	}
+
 	return nil
 }
@@ -1,9 +1,7 @@
 package recipes
 
 import (
-	"os"
 	"os/exec"
-	"path/filepath"
 
 	"github.com/andrew-d/sbuild/builder"
 	"github.com/andrew-d/sbuild/recipes/templates"
@@ -29,6 +27,9 @@ func (r *PcreRecipe) Info() *types.RecipeInfo {
 			"51679ea8006ce31379fb0860e46dd86665d864b5020fc9cd19e71260eef4789d",
 		},
 		Library: true,
+		Exports: types.LibraryExports{
+			Libs: []string{"pcre"},
+		},
 	}
 }
 
@@ -46,26 +47,23 @@ func (r *PcreRecipe) Build(ctx *types.BuildContext) error {
 		"--enable-static",
 		"--host="+ctx.CrossPrefix,
 		"--build=i686",
+		"--prefix="+ctx.Prefix,
 	)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Set("CFLAGS", ctx.StaticFlags).
 		Set("CXXFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
 
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -76,13 +74,10 @@ func (r *PcreRecipe) Build(ctx *types.BuildContext) error {
 
 func (r *PcreRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
-	ctx.AddDependentEnvVar(
-		"CPPFLAGS",
-		"-I"+srcdir,
-	)
-	ctx.AddDependentEnvVar(
-		"LDFLAGS",
-		"-L"+filepath.Join(srcdir, ".libs")+" -lpcre",
-	)
+	if err := r.Install(ctx, srcdir); err != nil {
+		log.WithField("err", err).Error("Could not install PCRE")
+		return err
+	}
+
 	return nil
 }
@@ -2,7 +2,6 @@ package recipes
 
 import (
 	"fmt"
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -32,6 +31,9 @@ func (r *PvRecipe) Info() *types.RecipeInfo {
 			"0ece824e0da27b384d11d1de371f20cafac465e038041adab57fcf4b5036ef8d",
 		},
 		Binary: true,
+		Tests: []types.TestCommand{
+			{Args: []string{"pv", "--version"}},
+		},
 	}
 }
 
@@ -57,10 +59,8 @@ func (r *PvRecipe) Build(ctx *types.BuildContext) error {
 		Append("CC", ctx.StaticFlags).
 		Set("CFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
@@ -72,7 +72,7 @@ func (r *PvRecipe) Build(ctx *types.BuildContext) error {
 		fmt.Sprintf("/^CC =/a LD = %s", ctx.Env.Get("LD")),
 		filepath.Join(srcdir, "Makefile"),
 	)
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not patch Makefile")
 		return err
 	}
@@ -80,10 +80,8 @@ func (r *PvRecipe) Build(ctx *types.BuildContext) error {
 	// 3. Run build
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
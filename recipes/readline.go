@@ -1,7 +1,6 @@
 package recipes
 
 import (
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -28,12 +27,23 @@ func (r *ReadlineRecipe) Info() *types.RecipeInfo {
 		Sums: []string{
 			"56ba6071b9462f980c5a72ab0023893b65ba6debb4eeb475d7a563dc65cafd43",
 		},
+		Mirrors: [][]string{
+			{
+				"https://ftp.gnu.org/gnu/readline/readline-${version}.tar.gz",
+				"https://ftpmirror.gnu.org/readline/readline-${version}.tar.gz",
+			},
+		},
 		Library: true,
+		Exports: types.LibraryExports{
+			Libs: []string{"readline"},
+		},
 	}
 }
 
 func (r *ReadlineRecipe) Dependencies(platform, arch string) []string {
-	return nil
+	// readline uses termcap functions from ncurses, so anything linking
+	// against readline must also link against ncurses.
+	return []string{"ncurses"}
 }
 
 func (r *ReadlineRecipe) Prepare(ctx *types.BuildContext) error {
@@ -46,16 +56,14 @@ func (r *ReadlineRecipe) Prepare(ctx *types.BuildContext) error {
 		"s|examples/Makefile||g",
 		filepath.Join(srcdir, "configure.ac"),
 	)
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not patch configure.ac")
 		return err
 	}
 
 	cmd = exec.Command("autoconf")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run autoconf")
 		return err
 	}
@@ -67,32 +75,29 @@ func (r *ReadlineRecipe) Build(ctx *types.BuildContext) error {
 	log.Info("Building readline")
 	srcdir := r.UnpackedDir(ctx, r.Info())
 
-	cmd := exec.Command(
-		"./configure",
+	args := append([]string{
 		"--disable-shared",
 		"--enable-static",
-		"--host="+ctx.CrossPrefix,
+		"--host=" + ctx.CrossPrefix,
 		"--build=i686",
-	)
+		"--prefix=" + ctx.Prefix,
+	}, ctx.ConfigureFlags...)
+	cmd := exec.Command("./configure", args...)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Set("CFLAGS", ctx.StaticFlags).
 		Set("CXXFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
 
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -103,22 +108,10 @@ func (r *ReadlineRecipe) Build(ctx *types.BuildContext) error {
 
 func (r *ReadlineRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
-	ctx.AddDependentEnvVar(
-		"LDFLAGS",
-		"-L"+srcdir+" -lreadline",
-	)
-
-	// Note: most things will attempt to #include readline as
-	// `readline/readline.h`.  We create a symlink such that this works.
-	oldname := srcdir
-	newname := filepath.Join(ctx.SourceDir, "readline")
-	if err := os.Symlink(oldname, newname); err != nil {
+	if err := r.Install(ctx, srcdir); err != nil {
+		log.WithField("err", err).Error("Could not install readline")
 		return err
 	}
 
-	ctx.AddDependentEnvVar(
-		"CPPFLAGS",
-		"-I"+ctx.SourceDir,
-	)
 	return nil
 }
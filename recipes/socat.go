@@ -1,7 +1,6 @@
 package recipes
 
 import (
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -31,6 +30,9 @@ func (r *SocatRecipe) Info() *types.RecipeInfo {
 			"f8de4a2aaadb406a2e475d18cf3b9f29e322d4e5803d8106716a01fd4e64b186",
 		},
 		Binary: true,
+		Tests: []types.TestCommand{
+			{Args: []string{"socat", "-V"}, Output: "socat version"},
+		},
 	}
 }
 
@@ -45,31 +47,27 @@ func (r *SocatRecipe) Build(ctx *types.BuildContext) error {
 	var cmd *exec.Cmd
 
 	log.Infof("Running ./configure")
-	cmd = exec.Command(
-		"./configure",
-		"--host="+ctx.CrossPrefix,
+	args := append([]string{
+		"--host=" + ctx.CrossPrefix,
 		"--build=i686",
-	)
+	}, ctx.ConfigureFlags...)
+	cmd = exec.Command("./configure", args...)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Append("CC", ctx.StaticFlags).
 		Append("CPPFLAGS", "-DNETDB_INTERNAL=-1").
 		Set("CFLAGS", "-fPIC "+ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
 
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -3,7 +3,6 @@ package recipes
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -33,6 +32,9 @@ func (r *StraceRecipe) Info() *types.RecipeInfo {
 			"e6180d866ef9e76586b96e2ece2bfeeb3aa23f5cc88153f76e9caedd65e40ee2",
 		},
 		Binary: true,
+		Tests: []types.TestCommand{
+			{Args: []string{"strace", "-V"}, Output: "strace -- version"},
+		},
 	}
 }
 
@@ -40,6 +42,12 @@ func (r *StraceRecipe) Dependencies(platform, arch string) []string {
 	return nil
 }
 
+func (r *StraceRecipe) Assets() map[string][]byte {
+	return map[string][]byte{
+		"strace.patch": stracePatch,
+	}
+}
+
 func (r *StraceRecipe) Prepare(ctx *types.BuildContext) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
 
@@ -48,7 +56,7 @@ func (r *StraceRecipe) Prepare(ctx *types.BuildContext) error {
 	cmd.Stdin = bytes.NewBuffer(bytes.TrimLeft(stracePatch, "\r\n"))
 	cmd.Dir = srcdir
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not patch source")
 		return err
 	}
@@ -73,10 +81,8 @@ func (r *StraceRecipe) Build(ctx *types.BuildContext) error {
 	cmd.Env = ctx.Env.
 		Set("CFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
@@ -88,7 +94,7 @@ func (r *StraceRecipe) Build(ctx *types.BuildContext) error {
 		fmt.Sprintf("/^CC =/a LD = %s", ctx.Env.Get("LD")),
 		filepath.Join(srcdir, "Makefile"),
 	)
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not patch Makefile")
 		return err
 	}
@@ -96,10 +102,8 @@ func (r *StraceRecipe) Build(ctx *types.BuildContext) error {
 	// 3. Run build
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
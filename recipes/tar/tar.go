@@ -2,7 +2,6 @@ package tar
 
 import (
 	"bytes"
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -36,7 +35,15 @@ func (r *TarRecipe) Info() *types.RecipeInfo {
 		Sums: []string{
 			"64ee8d88ec1b47a0961033493f919d27218c41b580138fd6802327462aff22f2",
 		},
+		Mirrors: [][]string{
+			{
+				"https://ftpmirror.gnu.org/tar/tar-${version}.tar.xz",
+			},
+		},
 		Binary: true,
+		Tests: []types.TestCommand{
+			{Args: []string{"tar", "--version"}, Output: "GNU tar"},
+		},
 	}
 }
 
@@ -44,6 +51,10 @@ func (r *TarRecipe) Dependencies(platform, arch string) []string {
 	return []string{"libiconv"}
 }
 
+func (r *TarRecipe) Assets() map[string][]byte {
+	return templates.CollectAssets(AssetNames(), MustAsset)
+}
+
 func (r *TarRecipe) Prepare(ctx *types.BuildContext) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
 
@@ -62,10 +73,8 @@ func (r *TarRecipe) Prepare(ctx *types.BuildContext) error {
 		cmd := exec.Command("patch", "-p1")
 		cmd.Dir = srcdir
 		cmd.Stdin = bytes.NewBuffer(MustAsset(patch))
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 
-		if err := cmd.Run(); err != nil {
+		if err := ctx.Run(cmd); err != nil {
 			log.WithFields(logrus.Fields{
 				"patch": patch,
 				"err":   err,
@@ -85,19 +94,17 @@ func (r *TarRecipe) Build(ctx *types.BuildContext) error {
 
 	// 1. Configure
 	log.Infof("Running ./configure")
-	cmd = exec.Command(
-		"./configure",
-		"--host="+ctx.CrossPrefix,
+	args := append([]string{
+		"--host=" + ctx.CrossPrefix,
 		"--build=i686",
-	)
+	}, ctx.ConfigureFlags...)
+	cmd = exec.Command("./configure", args...)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Set("CFLAGS", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
@@ -105,10 +112,8 @@ func (r *TarRecipe) Build(ctx *types.BuildContext) error {
 	// 2. Run build
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -117,6 +122,18 @@ func (r *TarRecipe) Build(ctx *types.BuildContext) error {
 	return nil
 }
 
+func (r *TarRecipe) Check(ctx *types.BuildContext) error {
+	cmd := exec.Command("make", "check")
+	cmd.Dir = r.UnpackedDir(ctx, r.Info())
+
+	if err := ctx.Run(cmd); err != nil {
+		log.WithField("err", err).Error("Could not run tar test suite")
+		return err
+	}
+
+	return nil
+}
+
 func (r *TarRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
 
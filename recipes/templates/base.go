@@ -37,7 +37,23 @@ func (r *BaseRecipe) Strip(ctx *types.BuildContext, file string) error {
 		ctx.Env.Get("STRIP"),
 		file,
 	)
-	return cmd.Run()
+	return ctx.Run(cmd)
+}
+
+// Install runs `make install` (or the given make targets) in the given
+// directory, installing into the recipe's staging directory.
+func (r *BaseRecipe) Install(ctx *types.BuildContext, dir string, targets ...string) error {
+	if len(targets) == 0 {
+		targets = []string{"install"}
+	}
+
+	args := append([]string{}, targets...)
+	args = append(args, "DESTDIR="+ctx.StagingDir)
+
+	cmd := exec.Command("make", args...)
+	cmd.Dir = dir
+	cmd.Env = ctx.Env.AsSlice()
+	return ctx.Run(cmd)
 }
 
 // CopyFile will copy a file from one location to another.
@@ -63,3 +79,14 @@ func (r *BaseRecipe) CopyFile(source, target string, mode os.FileMode) error {
 
 	return nil
 }
+
+// CollectAssets returns the contents of all the given assets, keyed by name.
+// It is intended to be used with the functions generated by go-bindata when
+// implementing types.AssetRecipe.
+func CollectAssets(names []string, asset func(string) []byte) map[string][]byte {
+	ret := make(map[string][]byte, len(names))
+	for _, name := range names {
+		ret[name] = asset(name)
+	}
+	return ret
+}
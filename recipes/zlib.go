@@ -2,7 +2,6 @@ package recipes
 
 import (
 	"fmt"
-	"os"
 	"os/exec"
 	"path/filepath"
 
@@ -29,7 +28,15 @@ func (r *ZlibRecipe) Info() *types.RecipeInfo {
 		Sums: []string{
 			"36658cb768a54c1d4dec43c3116c27ed893e88b02ecfcb44f2166f9c0b7f2a0d",
 		},
+		Mirrors: [][]string{
+			{
+				"https://zlib.net/fossils/zlib-${version}.tar.gz",
+			},
+		},
 		Library: true,
+		Exports: types.LibraryExports{
+			Libs: []string{"z"},
+		},
 	}
 }
 
@@ -42,17 +49,15 @@ func (r *ZlibRecipe) Build(ctx *types.BuildContext) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
 
 	// 1. Configure
-	cmd := exec.Command("./configure", "--static")
+	cmd := exec.Command("./configure", "--static", "--prefix="+ctx.Prefix)
 	cmd.Dir = srcdir
 	cmd.Env = ctx.Env.
 		Set("CHOST", ctx.CrossPrefix).
 		Set("CFLAGS", ctx.StaticFlags).
 		Append("CC", ctx.StaticFlags).
 		AsSlice()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run configure")
 		return err
 	}
@@ -68,7 +73,7 @@ func (r *ZlibRecipe) Build(ctx *types.BuildContext) error {
 			"s|ARFLAGS=-o|ARFLAGS=rc|g",
 			filepath.Join(srcdir, "Makefile"),
 		)
-		if err := cmd.Run(); err != nil {
+		if err := ctx.Run(cmd); err != nil {
 			log.WithField("err", err).Error("Could not patch Makefile")
 			return err
 		}
@@ -77,10 +82,8 @@ func (r *ZlibRecipe) Build(ctx *types.BuildContext) error {
 	// 3. Run build
 	cmd = exec.Command("make")
 	cmd.Dir = srcdir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
 
-	if err := cmd.Run(); err != nil {
+	if err := ctx.Run(cmd); err != nil {
 		log.WithField("err", err).Error("Could not run make")
 		return err
 	}
@@ -89,15 +92,24 @@ func (r *ZlibRecipe) Build(ctx *types.BuildContext) error {
 	return nil
 }
 
+func (r *ZlibRecipe) Check(ctx *types.BuildContext) error {
+	cmd := exec.Command("make", "check")
+	cmd.Dir = r.UnpackedDir(ctx, r.Info())
+
+	if err := ctx.Run(cmd); err != nil {
+		log.WithField("err", err).Error("Could not run zlib test suite")
+		return err
+	}
+
+	return nil
+}
+
 func (r *ZlibRecipe) Finalize(ctx *types.BuildContext, outDir string) error {
 	srcdir := r.UnpackedDir(ctx, r.Info())
-	ctx.AddDependentEnvVar(
-		"CPPFLAGS",
-		"-I"+srcdir,
-	)
-	ctx.AddDependentEnvVar(
-		"LDFLAGS",
-		"-L"+srcdir+" -lz",
-	)
+	if err := r.Install(ctx, srcdir); err != nil {
+		log.WithField("err", err).Error("Could not install zlib")
+		return err
+	}
+
 	return nil
 }
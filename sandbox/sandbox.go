@@ -0,0 +1,65 @@
+// Package sandbox runs commands in an isolated environment, where they have no
+// network access and can only see an explicit set of paths from the host.
+package sandbox
+
+// The name that the sandbox's init process is started with.
+const initArg = "sbuild-sandbox-init"
+
+// The environment variable that the sandbox's init process reads its spec
+// from.
+const specEnvVar = "SBUILD_SANDBOX_SPEC"
+
+// Mounts describes which host paths are visible inside a sandbox.  Paths
+// appear at the same location inside the sandbox as outside it, and paths that
+// don't exist on the host are ignored.
+type Mounts struct {
+	// Paths that can be modified from inside the sandbox.
+	ReadWrite []string
+
+	// Paths that are visible but can't be modified.
+	ReadOnly []string
+}
+
+// DefaultPaths returns the host paths that are made visible (read-only) in a
+// sandbox by default: the system's programs, libraries and data files, but not
+// its headers (/usr/include) or anything belonging to users.
+func DefaultPaths() []string {
+	return []string{
+		"/bin",
+		"/sbin",
+		"/lib",
+		"/lib32",
+		"/lib64",
+		"/libx32",
+		"/usr/bin",
+		"/usr/sbin",
+		"/usr/lib",
+		"/usr/lib32",
+		"/usr/lib64",
+		"/usr/libx32",
+		"/usr/libexec",
+		"/usr/share",
+		"/etc/alternatives",
+		"/etc/group",
+		"/etc/ld.so.cache",
+		"/etc/ld.so.conf",
+		"/etc/ld.so.conf.d",
+		"/etc/nsswitch.conf",
+		"/etc/passwd",
+	}
+}
+
+// spec is passed to the sandbox's init process, and describes the sandbox
+// along with the command to run in it.
+type spec struct {
+	Mounts Mounts
+
+	Path string
+	Args []string
+	Env  []string
+	Dir  string
+
+	// The user and group that run the sandbox, which the command runs as.
+	Uid int
+	Gid int
+}
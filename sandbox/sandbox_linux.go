@@ -0,0 +1,419 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Supported is whether sandboxing is supported on this platform.
+const Supported = true
+
+// Device nodes that are made available inside the sandbox.
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// Main must be called at the very start of main() by any program that uses
+// Command.  If the current process is a sandbox's init process, it sets up the
+// sandbox, runs the command in it and exits with the command's exit status;
+// otherwise, it returns immediately.
+func Main() {
+	if len(os.Args) == 0 || os.Args[0] != initArg {
+		return
+	}
+
+	os.Exit(runInit())
+}
+
+// Command returns a command that runs the given command in a sandbox, with
+// its own user, mount, PID and network namespaces.  Inside the sandbox there
+// is no network access, only the given host paths are visible, and everything
+// except the read-write mounts is read-only.  The command runs as the same
+// user as the caller.
+//
+// The returned command uses the original command's standard input and output.
+// The original command must not have been started, and must have its Env set,
+// since nothing from our own environment is passed into the sandbox.
+func Command(cmd *exec.Cmd, mounts *Mounts) (*exec.Cmd, error) {
+	if cmd.Env == nil {
+		return nil, errors.New("sandbox: command has no environment")
+	}
+
+	s := &spec{
+		Mounts: *mounts,
+		Path:   cmd.Path,
+		Args:   cmd.Args,
+		Env:    cmd.Env,
+		Dir:    cmd.Dir,
+		Uid:    os.Getuid(),
+		Gid:    os.Getgid(),
+	}
+	if s.Dir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		s.Dir = dir
+	}
+
+	// Relative paths would be resolved against the sandbox's root.
+	if !filepath.IsAbs(s.Path) && strings.Contains(s.Path, "/") {
+		s.Path = filepath.Join(s.Dir, s.Path)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &exec.Cmd{
+		Path:   "/proc/self/exe",
+		Args:   []string{initArg},
+		Env:    []string{specEnvVar + "=" + string(data)},
+		Stdin:  cmd.Stdin,
+		Stdout: cmd.Stdout,
+		Stderr: cmd.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER |
+				syscall.CLONE_NEWNS |
+				syscall.CLONE_NEWPID |
+				syscall.CLONE_NEWNET,
+			UidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: s.Uid, Size: 1},
+			},
+			GidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: s.Gid, Size: 1},
+			},
+			GidMappingsEnableSetgroups: false,
+			Pdeathsig:                  syscall.SIGKILL,
+		},
+	}
+	return ret, nil
+}
+
+// Runs inside the sandbox's namespaces as PID 1: sets up the sandbox's root,
+// then runs the command and returns its exit status.
+func runInit() int {
+	var s spec
+	if err := json.Unmarshal([]byte(os.Getenv(specEnvVar)), &s); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: invalid spec: %s\n", err)
+		return 127
+	}
+
+	if err := setupRoot(&s); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+		return 127
+	}
+	if _, err := os.Stat(s.Dir); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: working directory is not visible: %s\n", s.Dir)
+		return 127
+	}
+
+	// We're root in our user namespace, which some build scripts refuse to
+	// run as, so run the command in a nested user namespace that maps back to
+	// the original user.
+	cmd := &exec.Cmd{
+		Path:   s.Path,
+		Args:   s.Args,
+		Env:    s.Env,
+		Dir:    s.Dir,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER,
+			UidMappings: []syscall.SysProcIDMap{
+				{ContainerID: s.Uid, HostID: 0, Size: 1},
+			},
+			GidMappings: []syscall.SysProcIDMap{
+				{ContainerID: s.Gid, HostID: 0, Size: 1},
+			},
+			GidMappingsEnableSetgroups: false,
+			Pdeathsig:                  syscall.SIGKILL,
+		},
+	}
+	if !strings.Contains(cmd.Path, "/") {
+		path, err := lookPath(cmd.Path, s.Env)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+			return 127
+		}
+		cmd.Path = path
+	}
+
+	// As PID 1, we only receive signals that we handle, so forward them.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+		return 127
+	}
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+	return 127
+}
+
+// Searches the PATH in the given environment for an executable.
+func lookPath(file string, env []string) (string, error) {
+	var path string
+	for _, v := range env {
+		if strings.HasPrefix(v, "PATH=") {
+			path = v[len("PATH="):]
+		}
+	}
+
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		candidate := filepath.Join(dir, file)
+		if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in $PATH", file)
+}
+
+// Builds the sandbox's root filesystem and switches to it.
+//
+// This works like bubblewrap: a tmpfs is mounted and becomes the root, with the
+// host's root moved to /oldroot, so host paths can be bind-mounted into
+// /newroot from there.  Finally /newroot becomes the root and the host's root
+// is detached.
+func setupRoot(s *spec) error {
+	// Don't let any of our mounts propagate back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %s", err)
+	}
+
+	base := "/tmp"
+	if err := syscall.Mount("tmpfs", base, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting tmpfs: %s", err)
+	}
+	for _, dir := range []string{"newroot", "oldroot"} {
+		if err := os.Mkdir(filepath.Join(base, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.PivotRoot(base, filepath.Join(base, "oldroot")); err != nil {
+		return fmt.Errorf("pivot_root: %s", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	// Make /newroot a mount point, so it can be made read-only and become the
+	// root later.
+	if err := syscall.Mount("/newroot", "/newroot", "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting new root: %s", err)
+	}
+
+	// /tmp is mounted first, since the paths we bind-mount might be inside
+	// it.
+	if err := os.MkdirAll("/newroot/tmp", 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", "/newroot/tmp", "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mounting /tmp: %s", err)
+	}
+
+	if err := bindAll(s.Mounts.ReadOnly, s.Mounts.ReadWrite); err != nil {
+		return err
+	}
+	if err := setupSpecial(); err != nil {
+		return err
+	}
+
+	if err := syscall.Unmount("/oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching host root: %s", err)
+	}
+	if err := syscall.Mount("", "/newroot", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("making root read-only: %s", err)
+	}
+
+	if err := os.Chdir("/newroot"); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %s", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching old root: %s", err)
+	}
+	return os.Chdir("/")
+}
+
+type bindMount struct {
+	path     string
+	readOnly bool
+}
+
+// Bind-mounts the given host paths into /newroot.  Parents are mounted before
+// their children, so that a read-write directory inside a read-only one is
+// still writable.
+func bindAll(readOnly, readWrite []string) error {
+	var mounts []bindMount
+	for _, path := range readOnly {
+		mounts = append(mounts, bindMount{filepath.Clean(path), true})
+	}
+	for _, path := range readWrite {
+		mounts = append(mounts, bindMount{filepath.Clean(path), false})
+	}
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i].path, "/") < strings.Count(mounts[j].path, "/")
+	})
+
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.path) {
+			return fmt.Errorf("mount path is not absolute: %s", m.path)
+		}
+		if err := bind(m); err != nil {
+			return fmt.Errorf("mounting %s: %s", m.path, err)
+		}
+	}
+	return nil
+}
+
+func bind(m bindMount) error {
+	src := filepath.Join("/oldroot", m.path)
+	dst := filepath.Join("/newroot", m.path)
+
+	fi, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// Re-create symlinks (e.g. /lib -> usr/lib) rather than following them,
+	// so their targets only appear if they're mounted too.
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			return nil
+		}
+		return os.Symlink(target, dst)
+	}
+
+	if err := makeMountPoint(dst, fi.IsDir()); err != nil {
+		return err
+	}
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if !m.readOnly {
+		return nil
+	}
+
+	// Remounting has to keep the flags that are locked because the mount came
+	// from a more privileged namespace.
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dst, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range []uintptr{
+		syscall.MS_NOSUID,
+		syscall.MS_NODEV,
+		syscall.MS_NOEXEC,
+		syscall.MS_NOATIME,
+		syscall.MS_NODIRATIME,
+		syscall.MS_RELATIME,
+	} {
+		if uintptr(st.Flags)&f != 0 {
+			flags |= f
+		}
+	}
+	return syscall.Mount("", dst, "", flags, "")
+}
+
+// Creates an empty file or directory to mount over, if nothing is there yet.
+func makeMountPoint(path string, dir bool) error {
+	if _, err := os.Lstat(path); err == nil {
+		return nil
+	}
+	if dir {
+		return os.MkdirAll(path, 0755)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Sets up /proc and /dev in the new root.
+func setupSpecial() error {
+	if err := os.MkdirAll("/newroot/proc", 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", "/newroot/proc", "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %s", err)
+	}
+
+	if err := os.MkdirAll("/newroot/dev", 0755); err != nil {
+		return err
+	}
+	for _, name := range devices {
+		src := filepath.Join("/oldroot/dev", name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+
+		dst := filepath.Join("/newroot/dev", name)
+		if err := makeMountPoint(dst, false); err != nil {
+			return err
+		}
+		if err := syscall.Mount(src, dst, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("mounting /dev/%s: %s", name, err)
+		}
+	}
+
+	links := map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join("/newroot/dev", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
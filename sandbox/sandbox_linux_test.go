@@ -0,0 +1,91 @@
+package sandbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// The sandbox's init process re-runs the test binary.
+	Main()
+	os.Exit(m.Run())
+}
+
+// Runs a shell script in a sandbox, returning its output.
+func runSandboxed(t *testing.T, mounts *Mounts, dir, script string) (string, error) {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Dir = dir
+	cmd.Env = []string{"PATH=/usr/bin:/bin"}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	sandboxed, err := Command(cmd, mounts)
+	require.NoError(t, err)
+	err = sandboxed.Run()
+	return out.String(), err
+}
+
+func TestSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rw := filepath.Join(dir, "rw")
+	ro := filepath.Join(dir, "ro")
+	hidden := filepath.Join(dir, "hidden")
+	for _, d := range []string{rw, ro, hidden} {
+		require.NoError(t, os.Mkdir(d, 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ro, "file"), []byte("hello"), 0644))
+
+	mounts := &Mounts{
+		ReadWrite: []string{rw},
+		ReadOnly:  append(DefaultPaths(), ro),
+	}
+	if out, err := runSandboxed(t, mounts, rw, "true"); err != nil {
+		t.Skipf("cannot create a sandbox here: %s: %s", err, out)
+	}
+
+	out, err := runSandboxed(t, mounts, rw, `
+		set -e
+		echo ok > out
+		cat `+ro+`/file
+		echo
+		id -u
+		if touch `+ro+`/new 2>/dev/null; then echo "ro writable"; fi
+		if [ -e `+hidden+` ]; then echo "hidden visible"; fi
+		if [ -e /usr/include ]; then echo "usr/include visible"; fi
+		if touch /newfile 2>/dev/null; then echo "root writable"; fi
+		touch /tmp/scratch
+		grep -v '^ *lo:' /proc/net/dev | grep ':' || true
+		exit 3
+	`)
+	// The command's exit status is passed through.
+	require.Error(t, err)
+	assert.Equal(t, "exit status 3", err.Error())
+
+	// Nothing but the file's contents and our user ID should be printed.
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Equal(t, []string{"hello", strconv.Itoa(os.Getuid())}, lines)
+
+	data, err := ioutil.ReadFile(filepath.Join(rw, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok\n", string(data))
+}
+
+func TestCommandNeedsEnv(t *testing.T) {
+	// Our own environment is never passed into the sandbox by default.
+	_, err := Command(exec.Command("true"), &Mounts{ReadOnly: DefaultPaths()})
+	assert.Error(t, err)
+}
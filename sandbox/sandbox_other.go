@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Supported is whether sandboxing is supported on this platform.
+const Supported = false
+
+// Main does nothing on this platform.
+func Main() {}
+
+// Command always fails on this platform.
+func Command(cmd *exec.Cmd, mounts *Mounts) (*exec.Cmd, error) {
+	return nil, errors.New("sandbox: not supported on this platform")
+}
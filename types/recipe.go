@@ -1,11 +1,18 @@
 package types
 
 import (
+	"context"
+	"os/exec"
+
 	"github.com/andrew-d/sbuild/env"
 )
 
 // BuildContext encapsulates information about a particular build.
 type BuildContext struct {
+	// Cancelled when the build is interrupted, or when the current phase or
+	// recipe times out.  Commands run with Run() are stopped automatically.
+	Context context.Context
+
 	// Contains a copy (or symlink) of the fetched sources, and should be used
 	// to perform all build operations.
 	SourceDir string
@@ -16,6 +23,30 @@ type BuildContext struct {
 	// Cross compiler prefix.
 	CrossPrefix string
 
+	// The prefix that library recipes should be configured with (e.g. with
+	// `./configure --prefix=$Prefix`).
+	Prefix string
+
+	// Library recipes should install into this directory during Finalize()
+	// (e.g. with `make install DESTDIR=$StagingDir`).  Everything installed
+	// here is made available to the recipe's dependents.
+	StagingDir string
+
+	// Contains everything installed by this recipe's dependencies, under
+	// Prefix.  The environment is already set up to search this directory
+	// for headers, libraries and pkg-config files.
+	SysrootDir string
+
+	// Flags of the form `--with-<dependency>=<path>` for every library this
+	// recipe depends on, which recipes pass to autoconf-style configure
+	// scripts.  Those scripts only warn about options they don't recognize.
+	ConfigureFlags []string
+
+	// The libraries exported by all dependencies, in the order they must be
+	// passed to the linker (e.g. "-lreadline -lncurses").  This is also set
+	// as LIBS in the environment.
+	Libs string
+
 	// Flags to make a build static.
 	StaticFlags string
 
@@ -29,6 +60,13 @@ type BuildContext struct {
 	// Call this during Finalize() in order to add environment variables to
 	// this recipe's dependents.
 	AddDependentEnvVar func(key, value string)
+
+	// Runs a command, capturing its output in the log for the current phase
+	// unless the command's Stdout or Stderr are already set.  Commands without
+	// an Env are run in Env.  The command is run in its own process group,
+	// which is killed if Context is cancelled.
+	// Recipes should use this instead of calling cmd.Run() directly.
+	Run func(cmd *exec.Cmd) error
 }
 
 // Recipe is the main interface that must be implemented by things that can
@@ -51,10 +89,26 @@ type Recipe interface {
 
 	// Finalize the build.  If building a binary, files from the build should
 	// be copied to the output directory.  If building a library, the recipe
-	// should set the appropriate flags in the per-recipe environment.
+	// should install it into the staging directory.
 	Finalize(ctx *BuildContext, outDir string) error
 }
 
+// AssetRecipe can be implemented by recipes that embed additional inputs to
+// their build, such as patches.  The contents of these assets are included
+// when deciding whether a previous build of the recipe can be reused.
+type AssetRecipe interface {
+	// Assets() returns the contents of all embedded assets, keyed by name.
+	Assets() map[string][]byte
+}
+
+// CheckRecipe can be implemented by recipes that can run their upstream test
+// suite (e.g. `make check`).  It is only run when the target matches the host
+// and checks are enabled, after the recipe's outputs have been verified.
+type CheckRecipe interface {
+	// Check() runs the test suite in the build tree left by Build().
+	Check(ctx *BuildContext) error
+}
+
 // RecipeInfo is a struct containing information about a recipe.
 type RecipeInfo struct {
 	// The name of this recipe.  Cannot conflict with other names.
@@ -74,7 +128,68 @@ type RecipeInfo struct {
 	// SHA256 hashes for each source in `Sources`.
 	Sums []string
 
+	// Fallback URLs for each source in `Sources` (which may be shorter than
+	// `Sources`), which are tried in order if the source can't be downloaded
+	// from its own URL, or doesn't match its hash.  They can use the same
+	// variables as `Sources`, but not the `filename::` prefix.
+	Mirrors [][]string
+
 	// Whether this is a library or binary recipe (can be both).
 	Library bool
 	Binary  bool
+
+	// For library recipes, what dependents need in order to use the library.
+	Exports LibraryExports
+
+	// Names of host environment variables that the build needs (e.g.
+	// "http_proxy").  In hermetic builds, these are the only variables passed
+	// through from sbuild's environment.
+	HostEnv []string
+
+	// Commands that check that the recipe's outputs work, which are run
+	// when the target matches the host.
+	Tests []TestCommand
+
+	// Files in the output directory, other than executables, that the
+	// recipe's binaries need at runtime (e.g. "magic.mgc").  These are the
+	// only other files available when tests run in an empty root.
+	DataFiles []string
+
+	// The time the sources were released, as a Unix timestamp, which is used
+	// as SOURCE_DATE_EPOCH in reproducible builds.  If zero, the modification
+	// time of the newest file in the unpacked sources is used instead.
+	SourceDateEpoch int64
+
+	// The revision of this recipe.  This should be increased whenever the way
+	// a recipe is built changes without a change to its version or sources,
+	// so that previously-cached builds are not reused.
+	Revision int
+}
+
+// TestCommand is a smoke test that runs one of a recipe's outputs.
+type TestCommand struct {
+	// The command and its arguments.  The command is a path relative to the
+	// recipe's output directory (e.g. "tar"), and `${out}` in any argument is
+	// replaced with the output directory.  The command is run in the output
+	// directory.
+	Args []string
+
+	// If set, the command's output must contain this.
+	Output string
+}
+
+// LibraryExports describes how to compile and link against a library.  All
+// directories are relative to the install prefix in the sysroot.
+type LibraryExports struct {
+	// Additional directories to search for headers (e.g. "include/ncurses").
+	// The "include" directory is always searched.
+	IncludeDirs []string
+
+	// Additional directories to search for libraries.  The "lib" directory is
+	// always searched.
+	LibDirs []string
+
+	// Libraries to link against, without the `-l` prefix, in the order they
+	// must be passed to the linker (e.g. "ssl", "crypto").
+	Libs []string
 }
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long to wait for a cancelled command to exit after asking it to, before
+// killing it.
+const killGracePeriod = 5 * time.Second
+
+// RunCommand runs the given command in its own process group.  If the context
+// is cancelled before the command finishes, the whole process group is asked
+// to exit and then, if it hasn't done so after a short grace period, killed.
+// This ensures that no processes started by the command (e.g. compilers
+// started by make) are left behind.
+//
+// If the context is cancelled, its error is returned.
+func RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	stop := killOnCancel(ctx, cmd)
+	err := cmd.Wait()
+	stop()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// The commands that are currently running, so that KillAll can find them.
+var (
+	running     = make(map[*exec.Cmd]bool)
+	runningLock sync.Mutex
+)
+
+// KillAll immediately kills the process groups of all commands that are being
+// run by RunCommand, without waiting for them to exit.  This is for when we
+// need to exit at once, and don't want to leave anything behind.
+func KillAll() {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+
+	for cmd := range running {
+		killProcessGroup(cmd)
+	}
+}
+
+// Kills the process groups of the given started commands if the context is
+// cancelled.  The returned function must be called once the commands have
+// exited.
+func killOnCancel(ctx context.Context, cmds ...*exec.Cmd) (stop func()) {
+	runningLock.Lock()
+	for _, cmd := range cmds {
+		running[cmd] = true
+	}
+	runningLock.Unlock()
+
+	exited := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+		}
+
+		for _, cmd := range cmds {
+			terminateProcessGroup(cmd)
+		}
+
+		select {
+		case <-exited:
+		case <-time.After(killGracePeriod):
+			for _, cmd := range cmds {
+				killProcessGroup(cmd)
+			}
+		}
+	}()
+
+	return func() {
+		runningLock.Lock()
+		for _, cmd := range cmds {
+			delete(running, cmd)
+		}
+		runningLock.Unlock()
+
+		close(exited)
+		<-finished
+	}
+}
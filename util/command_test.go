@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCommand(t *testing.T) {
+	assert.NoError(t, RunCommand(context.Background(), exec.Command("true")))
+	assert.Error(t, RunCommand(context.Background(), exec.Command("false")))
+}
+
+func TestRunCommandKillsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// Start a child process in the background, print its PID, and wait.
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 30 & echo $!; wait")
+	cmd.Stdout = &stdout
+
+	start := time.Now()
+	err := RunCommand(ctx, cmd)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	// The child must have been killed along with the shell.
+	pid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	require.NoError(t, err)
+	assert.True(t, processExited(pid), "child process is still running")
+}
+
+func TestKillAll(t *testing.T) {
+	// The command ignores SIGTERM, so only killing it stops it.
+	stdout, w := io.Pipe()
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 30 & echo $!; wait")
+	cmd.Stdout = w
+
+	done := make(chan error, 1)
+	go func() {
+		done <- RunCommand(context.Background(), cmd)
+		w.Close()
+	}()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	require.NoError(t, err)
+
+	KillAll()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("command wasn't killed")
+	}
+	assert.True(t, processExited(pid), "child process is still running")
+}
+
+// Returns whether the given process has exited, waiting briefly for it to do
+// so.  Since the process isn't our child, it may remain as a zombie until it's
+// reaped, which also counts as having exited.
+func processExited(pid int) bool {
+	for i := 0; i < 50; i++ {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return true
+		}
+
+		// The state follows the command name, which is in parentheses.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) > 0 && fields[0] == "Z" {
+			return true
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
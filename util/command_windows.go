@@ -0,0 +1,18 @@
+package util
+
+import (
+	"os/exec"
+)
+
+// Windows doesn't have process groups that can be signalled, so only the
+// command itself is killed.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
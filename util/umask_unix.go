@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import (
+	"syscall"
+)
+
+// SetUmask sets the file mode creation mask of this process, and returns the
+// previous mask.
+func SetUmask(mask int) int {
+	return syscall.Umask(mask)
+}
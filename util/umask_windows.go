@@ -0,0 +1,6 @@
+package util
+
+// SetUmask does nothing, since Windows doesn't have a umask.
+func SetUmask(mask int) int {
+	return 0
+}
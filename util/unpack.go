@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"os/exec"
 	"strings"
@@ -11,39 +12,41 @@ var (
 	ErrUnknownArchive = errors.New("unpack: unknown archive format")
 )
 
-func UnpackArchive(archive, intoDir string) error {
+// UnpackArchive unpacks the given archive into a directory.  The commands used
+// to unpack it are stopped if the context is cancelled.
+func UnpackArchive(ctx context.Context, archive, intoDir string) error {
 	if strings.HasSuffix(archive, ".tar") {
-		return unpackTar(archive, intoDir)
+		return unpackTar(ctx, archive, intoDir)
 
 	} else if strings.HasSuffix(archive, ".tar.gz") || strings.HasSuffix(archive, ".tgz") {
-		return unpackTarGz(archive, intoDir)
+		return unpackTarGz(ctx, archive, intoDir)
 
 	} else if strings.HasSuffix(archive, ".tar.bz2") {
-		return unpackTarBz2(archive, intoDir)
+		return unpackTarBz2(ctx, archive, intoDir)
 
 	} else if strings.HasSuffix(archive, ".tar.lzma") {
 		// TODO
 
 	} else if strings.HasSuffix(archive, ".tar.xz") {
-		return unpackTarXz(archive, intoDir)
+		return unpackTarXz(ctx, archive, intoDir)
 
 	} else if strings.HasSuffix(archive, ".zip") {
-		return unpackZip(archive, intoDir)
+		return unpackZip(ctx, archive, intoDir)
 
 	}
 
 	return ErrUnknownArchive
 }
 
-func simpleUnpackCommand(f func(string, string) *exec.Cmd) func(string, string) error {
-	fn := func(archive, intoDir string) error {
+func simpleUnpackCommand(f func(string, string) *exec.Cmd) func(context.Context, string, string) error {
+	fn := func(ctx context.Context, archive, intoDir string) error {
 		cmd := f(archive, intoDir)
 
 		var stdout, stderr bytes.Buffer
 		cmd.Stdout = &stdout
 		cmd.Stderr = &stderr
 
-		if err := cmd.Run(); err != nil {
+		if err := RunCommand(ctx, cmd); err != nil {
 			// TODO: better logging
 			//fmt.Fprintf(msg.Output, "Stdout:\n%s", stdout.String())
 			//fmt.Fprintf(msg.Output, "Stderr:\n%s", stderr.String())
@@ -73,9 +76,11 @@ var (
 	})
 )
 
-func unpackTarXz(archive, intoDir string) error {
+func unpackTarXz(ctx context.Context, archive, intoDir string) error {
 	cmd1 := exec.Command("xz", "-d", "-c", archive)
 	cmd2 := exec.Command("tar", "-C", intoDir, "-x")
+	setProcessGroup(cmd1)
+	setProcessGroup(cmd2)
 
 	stdout1, err := cmd1.StdoutPipe()
 	if err != nil {
@@ -87,12 +92,22 @@ func unpackTarXz(archive, intoDir string) error {
 	if err := cmd2.Start(); err != nil {
 		return err
 	}
-	if err := cmd1.Run(); err != nil {
+	if err := cmd1.Start(); err != nil {
+		cmd2.Process.Kill()
+		cmd2.Wait()
 		return err
 	}
-	if err := cmd2.Wait(); err != nil {
+
+	stop := killOnCancel(ctx, cmd1, cmd2)
+	err1 := cmd1.Wait()
+	err2 := cmd2.Wait()
+	stop()
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-
-	return nil
+	if err1 != nil {
+		return err1
+	}
+	return err2
 }